@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	appTypeApk    = "apk"
+	appTypeBundle = "aab"
+)
+
+// detectAppType returns the type of the app under test based on its extension.
+func detectAppType(appPath string) string {
+	if strings.ToLower(filepath.Ext(appPath)) == ".aab" {
+		return appTypeBundle
+	}
+	return appTypeApk
+}
+
+// requiredBundleEntries are the entries every Android App Bundle has to contain.
+var requiredBundleEntries = []string{"BundleConfig.pb", "base/manifest/AndroidManifest.xml"}
+
+// validateAppBundle checks if the given file is a well-formed Android App Bundle.
+func validateAppBundle(bundlePath string) error {
+	reader, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return fmt.Errorf("app bundle (%s) is not a valid zip archive, error: %s", bundlePath, err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Warnf("Failed to close app bundle (%s), error: %s", bundlePath, err)
+		}
+	}()
+
+	entries := map[string]bool{}
+	for _, file := range reader.File {
+		entries[file.Name] = true
+	}
+
+	for _, entry := range requiredBundleEntries {
+		if !entries[entry] {
+			return fmt.Errorf("app bundle (%s) is malformed, missing entry: %s", bundlePath, entry)
+		}
+	}
+	if entries["AndroidManifest.xml"] {
+		return fmt.Errorf("app bundle (%s) is malformed, it has the layout of an APK", bundlePath)
+	}
+	return nil
+}
+
+const legacyInstrumentationTestRunner = "android.test.InstrumentationTestRunner"
+
+// orchestratorCompatibleRunners are the runner classes Android Test Orchestrator is able to drive,
+// custom runners have to extend one of these.
+var orchestratorCompatibleRunners = []string{
+	"androidx.test.runner.AndroidJUnitRunner",
+	"android.support.test.runner.AndroidJUnitRunner",
+}
+
+// classDescriptor returns the dex type descriptor of the given class name,
+// e.g. androidx.test.runner.AndroidJUnitRunner => Landroidx/test/runner/AndroidJUnitRunner;
+func classDescriptor(className string) []byte {
+	return []byte("L" + strings.Replace(className, ".", "/", -1) + ";")
+}
+
+// readDexFiles returns the content of every classes*.dex file in the given APK.
+func readDexFiles(apkPath string) ([][]byte, error) {
+	reader, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open apk (%s), error: %s", apkPath, err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Warnf("Failed to close apk (%s), error: %s", apkPath, err)
+		}
+	}()
+
+	dexFiles := [][]byte{}
+	for _, file := range reader.File {
+		name := path.Base(file.Name)
+		if file.Name != name || !strings.HasPrefix(name, "classes") || path.Ext(name) != ".dex" {
+			continue
+		}
+
+		content, err := readZipFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from apk (%s), error: %s", file.Name, apkPath, err)
+		}
+		dexFiles = append(dexFiles, content)
+	}
+
+	if len(dexFiles) == 0 {
+		return nil, fmt.Errorf("no dex file found in apk (%s)", apkPath)
+	}
+	return dexFiles, nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			log.Warnf("Failed to close %s, error: %s", file.Name, err)
+		}
+	}()
+
+	return ioutil.ReadAll(rc)
+}
+
+func dexFilesContain(dexFiles [][]byte, className string) bool {
+	descriptor := classDescriptor(className)
+	for _, dex := range dexFiles {
+		if bytes.Contains(dex, descriptor) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOrchestratorCompatibility checks that the test apk is built against AndroidJUnitRunner
+// and the given runner class (if any) is available in the test apk.
+func validateOrchestratorCompatibility(testApkPath, runnerClass string) error {
+	if runnerClass == legacyInstrumentationTestRunner {
+		return fmt.Errorf("test runner class (%s) is not supported by Android Test Orchestrator, use AndroidJUnitRunner or a subclass of it", runnerClass)
+	}
+
+	dexFiles, err := readDexFiles(testApkPath)
+	if err != nil {
+		return err
+	}
+
+	compatible := false
+	for _, runner := range orchestratorCompatibleRunners {
+		if dexFilesContain(dexFiles, runner) {
+			compatible = true
+			break
+		}
+	}
+	if !compatible {
+		return fmt.Errorf("test apk (%s) does not contain AndroidJUnitRunner, which is required by Android Test Orchestrator", testApkPath)
+	}
+
+	if runnerClass != "" && !dexFilesContain(dexFiles, runnerClass) {
+		return fmt.Errorf("test runner class (%s) not found in test apk (%s)", runnerClass, testApkPath)
+	}
+
+	return nil
+}
+
+const (
+	dexAccInterface = 0x200
+	dexAccAbstract  = 0x400
+)
+
+// listConcreteClasses returns the non abstract, non inner classes defined in the apk's dex files.
+func listConcreteClasses(apkPath string) ([]string, error) {
+	dexFiles, err := readDexFiles(apkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	classes := []string{}
+	for _, dex := range dexFiles {
+		dexClasses, err := parseDexClassDefs(dex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dex of apk (%s), error: %s", apkPath, err)
+		}
+		classes = append(classes, dexClasses...)
+	}
+	return classes, nil
+}
+
+// parseDexClassDefs reads the class_defs section of a dex file,
+// see: https://source.android.com/devices/tech/dalvik/dex-format
+func parseDexClassDefs(dex []byte) ([]string, error) {
+	const headerSize = 0x70
+	if len(dex) < headerSize || !bytes.HasPrefix(dex, []byte("dex\n")) {
+		return nil, fmt.Errorf("invalid dex header")
+	}
+
+	u32 := func(offset uint32) (uint32, error) {
+		if uint64(offset)+4 > uint64(len(dex)) {
+			return 0, fmt.Errorf("offset (%d) out of range", offset)
+		}
+		return binary.LittleEndian.Uint32(dex[offset:]), nil
+	}
+
+	stringIDsOff := binary.LittleEndian.Uint32(dex[0x3C:])
+	typeIDsOff := binary.LittleEndian.Uint32(dex[0x44:])
+	classDefsSize := binary.LittleEndian.Uint32(dex[0x60:])
+	classDefsOff := binary.LittleEndian.Uint32(dex[0x64:])
+
+	classes := []string{}
+	for i := uint32(0); i < classDefsSize; i++ {
+		classDefOff := classDefsOff + i*32
+		classIdx, err := u32(classDefOff)
+		if err != nil {
+			return nil, err
+		}
+		accessFlags, err := u32(classDefOff + 4)
+		if err != nil {
+			return nil, err
+		}
+		if accessFlags&(dexAccInterface|dexAccAbstract) != 0 {
+			continue
+		}
+
+		descriptorIdx, err := u32(typeIDsOff + classIdx*4)
+		if err != nil {
+			return nil, err
+		}
+		stringDataOff, err := u32(stringIDsOff + descriptorIdx*4)
+		if err != nil {
+			return nil, err
+		}
+		descriptor, err := readDexString(dex, stringDataOff)
+		if err != nil {
+			return nil, err
+		}
+
+		// Lcom/example/LoginTest; => com.example.LoginTest
+		if !strings.HasPrefix(descriptor, "L") || !strings.HasSuffix(descriptor, ";") || strings.Contains(descriptor, "$") {
+			continue
+		}
+		classes = append(classes, strings.Replace(descriptor[1:len(descriptor)-1], "/", ".", -1))
+	}
+	return classes, nil
+}
+
+// readDexString reads a string_data_item: an uleb128 length followed by the null terminated MUTF-8 data.
+func readDexString(dex []byte, offset uint32) (string, error) {
+	pos := uint64(offset)
+	for {
+		if pos >= uint64(len(dex)) {
+			return "", fmt.Errorf("string offset (%d) out of range", offset)
+		}
+		b := dex[pos]
+		pos++
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	end := bytes.IndexByte(dex[pos:], 0)
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string at offset (%d)", offset)
+	}
+	return string(dex[pos : pos+uint64(end)]), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type testDexClass struct {
+	descriptor  string
+	accessFlags uint32
+}
+
+// createTestDex returns a dex file with the header, the string_ids, type_ids and class_defs sections,
+// every class's descriptor is a separate string and type.
+func createTestDex(classes []testDexClass) []byte {
+	const headerSize = 0x70
+	stringIDsOff := uint32(headerSize)
+	typeIDsOff := stringIDsOff + uint32(len(classes))*4
+	classDefsOff := typeIDsOff + uint32(len(classes))*4
+	stringDataOff := classDefsOff + uint32(len(classes))*32
+
+	dex := make([]byte, stringDataOff)
+	copy(dex, "dex\n035\x00")
+	binary.LittleEndian.PutUint32(dex[0x3C:], stringIDsOff)
+	binary.LittleEndian.PutUint32(dex[0x44:], typeIDsOff)
+	binary.LittleEndian.PutUint32(dex[0x60:], uint32(len(classes)))
+	binary.LittleEndian.PutUint32(dex[0x64:], classDefsOff)
+
+	for i, class := range classes {
+		binary.LittleEndian.PutUint32(dex[stringIDsOff+uint32(i)*4:], uint32(len(dex)))
+		binary.LittleEndian.PutUint32(dex[typeIDsOff+uint32(i)*4:], uint32(i))
+		binary.LittleEndian.PutUint32(dex[classDefsOff+uint32(i)*32:], uint32(i))
+		binary.LittleEndian.PutUint32(dex[classDefsOff+uint32(i)*32+4:], class.accessFlags)
+
+		dex = append(dex, byte(len(class.descriptor)))
+		dex = append(dex, class.descriptor...)
+		dex = append(dex, 0)
+	}
+	return dex
+}
+
+func TestParseDexClassDefs(t *testing.T) {
+	tests := []struct {
+		name    string
+		dex     []byte
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "concrete classes",
+			dex: createTestDex([]testDexClass{
+				{descriptor: "Lcom/example/LoginTest;"},
+				{descriptor: "Lcom/example/SignupTest;", accessFlags: 0x1},
+			}),
+			want: []string{"com.example.LoginTest", "com.example.SignupTest"},
+		},
+		{
+			name: "interfaces, abstract and inner classes are skipped",
+			dex: createTestDex([]testDexClass{
+				{descriptor: "Lcom/example/Test;", accessFlags: dexAccInterface},
+				{descriptor: "Lcom/example/BaseTest;", accessFlags: dexAccAbstract},
+				{descriptor: "Lcom/example/LoginTest$1;"},
+				{descriptor: "Lcom/example/LoginTest;"},
+			}),
+			want: []string{"com.example.LoginTest"},
+		},
+		{
+			name: "no classes",
+			dex:  createTestDex(nil),
+			want: []string{},
+		},
+		{
+			name:    "invalid header",
+			dex:     append([]byte("zip\n"), make([]byte, 0x70)...),
+			wantErr: true,
+		},
+		{
+			name:    "too short",
+			dex:     []byte("dex\n035\x00"),
+			wantErr: true,
+		},
+		{
+			name: "class defs out of range",
+			dex: func() []byte {
+				dex := createTestDex([]testDexClass{{descriptor: "Lcom/example/LoginTest;"}})
+				binary.LittleEndian.PutUint32(dex[0x60:], 100)
+				return dex
+			}(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDexClassDefs(tt.dex)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDexClassDefs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDexClassDefs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
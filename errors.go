@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-tools/go-steputils/tools"
+)
+
+// Error categories of the step, exported to the FIREBASE_TEST_ERROR_CATEGORY environment variable.
+const (
+	errorCategoryTestFailure    = "test_failure"
+	errorCategoryConfiguration  = "configuration"
+	errorCategoryUpload         = "upload"
+	errorCategoryInfrastructure = "infrastructure"
+	errorCategoryTimeout        = "timeout"
+)
+
+// errorCategoryExitCodes are the documented exit codes of the error categories.
+var errorCategoryExitCodes = map[string]int{
+	errorCategoryTestFailure:    1,
+	errorCategoryConfiguration:  2,
+	errorCategoryUpload:         3,
+	errorCategoryInfrastructure: 4,
+	errorCategoryTimeout:        5,
+}
+
+// StepError is an error, which fails the step with the exit code of its category.
+type StepError struct {
+	Category string
+	Err      error
+}
+
+func (err *StepError) Error() string {
+	return err.Err.Error()
+}
+
+func newStepError(category string, format string, v ...interface{}) *StepError {
+	return &StepError{Category: category, Err: fmt.Errorf(format, v...)}
+}
+
+// withCategory returns the error with the given category and message, unless it is categorized already.
+func withCategory(err error, category string, message string) error {
+	if _, ok := err.(*StepError); ok {
+		return err
+	}
+	return newStepError(category, "%s, error: %s", message, err)
+}
+
+// exitCode returns the exit code of the error's category.
+func (err *StepError) exitCode() int {
+	if code, ok := errorCategoryExitCodes[err.Category]; ok {
+		return code
+	}
+	return 1
+}
+
+// failureCategoryPrecedence orders the device failure categories, the categories not worth retrying first.
+var failureCategoryPrecedence = map[string]int{
+	errorCategoryTestFailure:    4,
+	errorCategoryConfiguration:  3,
+	errorCategoryTimeout:        2,
+	errorCategoryInfrastructure: 1,
+}
+
+// testFailureCategory returns the category of the failed devices with the highest precedence:
+// a test failure if any of these failed because of its tests, then configuration, timeout and infrastructure.
+func testFailureCategory(failed []*DeviceResult) string {
+	if len(failed) == 0 {
+		return errorCategoryTestFailure
+	}
+
+	category := errorCategoryInfrastructure
+	for _, result := range failed {
+		if deviceCategory := deviceFailureCategory(result); failureCategoryPrecedence[deviceCategory] > failureCategoryPrecedence[category] {
+			category = deviceCategory
+		}
+	}
+	return category
+}
+
+// deviceFailureCategory returns the category of the device's failure: skipped devices, e.g. incompatible ones,
+// are configuration issues and inconclusive devices are infrastructure issues.
+// A failure is a timeout only if timing out is its only detail, e.g. a crash next to the timeout is a test failure.
+func deviceFailureCategory(result *DeviceResult) string {
+	if result.Outcome == nil || result.Outcome.Summary == "inconclusive" {
+		return errorCategoryInfrastructure
+	}
+	if result.Outcome.Summary == "skipped" {
+		return errorCategoryConfiguration
+	}
+	details := outcomeDetails(result.Outcome)
+	if len(details) == 0 {
+		return errorCategoryTestFailure
+	}
+	for _, detail := range details {
+		if detail != "TimedOut" {
+			return errorCategoryTestFailure
+		}
+	}
+	return errorCategoryTimeout
+}
+
+// exitWithError prints the error, exports its category and exits with the category's exit code.
+// Errors without category are infrastructure errors.
+func exitWithError(err error) {
+	stepErr, ok := err.(*StepError)
+	if !ok {
+		stepErr = &StepError{Category: errorCategoryInfrastructure, Err: err}
+	}
+
+	log.Errorf("%s", stepErr)
+	if exportErr := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_ERROR_CATEGORY", stepErr.Category); exportErr != nil {
+		log.Warnf("Failed to export environment (FIREBASE_TEST_ERROR_CATEGORY), error: %s", exportErr)
+	}
+	os.Exit(stepErr.exitCode())
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestTestFailureCategory(t *testing.T) {
+	newResult := func(outcome *Outcome) *DeviceResult {
+		return &DeviceResult{Outcome: outcome}
+	}
+	crashed := newResult(&Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true}})
+	timedOut := newResult(&Outcome{Summary: "failure", FailureDetail: &FailureDetail{TimedOut: true}})
+	crashedAndTimedOut := newResult(&Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true, TimedOut: true}})
+	incompatible := newResult(&Outcome{Summary: "skipped", SkippedDetail: &SkippedDetail{IncompatibleDevice: true}})
+	infrastructureFailure := newResult(&Outcome{Summary: "inconclusive", InconclusiveDetail: &InconclusiveDetail{InfrastructureFailure: true}})
+
+	tests := []struct {
+		name   string
+		failed []*DeviceResult
+		want   string
+	}{
+		{name: "no failed device", failed: nil, want: errorCategoryTestFailure},
+		{name: "crash", failed: []*DeviceResult{crashed}, want: errorCategoryTestFailure},
+		{name: "timeout", failed: []*DeviceResult{timedOut}, want: errorCategoryTimeout},
+		{name: "crash next to the timeout", failed: []*DeviceResult{crashedAndTimedOut}, want: errorCategoryTestFailure},
+		{name: "timed out and crashed devices", failed: []*DeviceResult{timedOut, crashed}, want: errorCategoryTestFailure},
+		{name: "timed out and inconclusive devices", failed: []*DeviceResult{infrastructureFailure, timedOut}, want: errorCategoryTimeout},
+		{name: "skipped device", failed: []*DeviceResult{incompatible, infrastructureFailure}, want: errorCategoryConfiguration},
+		{name: "passed device below the minimum test count", failed: []*DeviceResult{newResult(&Outcome{Summary: "success"})}, want: errorCategoryTestFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testFailureCategory(tt.failed); got != tt.want {
+				t.Errorf("testFailureCategory() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	htmlReportFileName = "firebase_test_report.html"
+	// htmlReportAssetsDirName is the directory next to the HTML report, which the not embedded assets are copied into.
+	htmlReportAssetsDirName = "firebase_test_report_assets"
+	// maxEmbeddedAssetSize limits the size of an image or video embedded into the HTML report.
+	maxEmbeddedAssetSize = 5 * 1024 * 1024
+	// maxEmbeddedTotalSize limits the total size of the assets embedded into the HTML report,
+	// the assets over the limit are copied next to the report and linked.
+	maxEmbeddedTotalSize = 20 * 1024 * 1024
+	// maxEmbeddedTextSize limits the embedded part of the text assets, e.g. logcat, keeping their end.
+	maxEmbeddedTextSize = 256 * 1024
+)
+
+// htmlReport is the data of the HTML report template.
+type htmlReport struct {
+	Summary *ResultsSummary
+	Devices []htmlReportDevice
+	// Assets are the downloaded assets, which do not belong to a device.
+	Assets []htmlReportAsset
+}
+
+type htmlReportDevice struct {
+	*DeviceSummary
+	Name        string
+	FailedTests []*TestCaseSummary
+	Assets      []htmlReportAsset
+}
+
+// htmlReportAsset is a downloaded test asset, embedded according to its kind: image, video, text or other.
+// Src is the embedded content's data URI or the relative url of the copied asset, Path is the local path if the copy failed.
+type htmlReportAsset struct {
+	Name string
+	Path string
+	Kind string
+	Src  template.URL
+	Text string
+}
+
+// createHTMLReport groups the downloaded assets by device, the assets of no device are listed separately.
+func createHTMLReport(summary *ResultsSummary, dir string) htmlReport {
+	report := htmlReport{Summary: summary}
+	loader := &htmlReportAssetLoader{assetsPath: summary.AssetsPath, reportDir: dir}
+
+	assigned := map[string]bool{}
+	for _, device := range summary.Devices {
+		reportDevice := htmlReportDevice{DeviceSummary: device, Name: deviceName(&DeviceResult{Dimensions: device.Dimensions})}
+		for _, testCase := range device.TestCases {
+			if testCase.Status == "failed" || testCase.Status == "error" {
+				reportDevice.FailedTests = append(reportDevice.FailedTests, testCase)
+			}
+		}
+
+		for _, asset := range device.Assets {
+			reportDevice.Assets = append(reportDevice.Assets, loader.load(asset))
+			assigned[asset] = true
+		}
+		report.Devices = append(report.Devices, reportDevice)
+	}
+
+	for _, asset := range summary.Assets {
+		if !assigned[asset] {
+			report.Assets = append(report.Assets, loader.load(asset))
+		}
+	}
+	return report
+}
+
+// htmlReportAssetLoader embeds the assets into the HTML report up to the total embed size,
+// the other assets are copied into the report's assets directory.
+type htmlReportAssetLoader struct {
+	assetsPath string
+	reportDir  string
+	// embeddedSize is the total size of the embedded assets, images and videos are counted base64 encoded
+	embeddedSize int64
+}
+
+func (loader *htmlReportAssetLoader) load(name string) htmlReportAsset {
+	asset := htmlReportAsset{Name: name, Path: filepath.Join(loader.assetsPath, name), Kind: "other"}
+
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		asset.Kind = "image"
+	case strings.HasPrefix(contentType, "video/"):
+		asset.Kind = "video"
+	case strings.HasPrefix(contentType, "text/"), filepath.Ext(name) == "", filepath.Ext(name) == ".log", filepath.Ext(name) == ".txt":
+		asset.Kind = "text"
+	}
+
+	info, err := os.Stat(asset.Path)
+	if err != nil {
+		asset.Kind = "other"
+		return asset
+	}
+
+	switch asset.Kind {
+	case "image", "video":
+		encodedSize := int64(base64.StdEncoding.EncodedLen(int(info.Size())))
+		if info.Size() <= maxEmbeddedAssetSize && loader.embeddedSize+encodedSize <= maxEmbeddedTotalSize {
+			if content, err := ioutil.ReadFile(asset.Path); err == nil {
+				loader.embeddedSize += encodedSize
+				asset.Src = template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(content))
+				return asset
+			}
+		}
+	case "text":
+		size := info.Size()
+		if size > maxEmbeddedTextSize {
+			size = maxEmbeddedTextSize
+		}
+		if loader.embeddedSize+size <= maxEmbeddedTotalSize {
+			if content, err := readFileEnd(asset.Path, maxEmbeddedTextSize); err == nil {
+				loader.embeddedSize += int64(len(content))
+				asset.Text = string(content)
+				return asset
+			}
+		}
+		asset.Kind = "other"
+	}
+
+	// images and videos are shown from the copy, the other assets are linked
+	src, err := loader.copy(name)
+	if err != nil {
+		log.Warnf("Failed to copy asset (%s) next to the HTML report, error: %s", name, err)
+		asset.Kind = "other"
+		return asset
+	}
+	asset.Src = src
+	return asset
+}
+
+// copy copies the asset into the report's assets directory and returns its url relative to the report.
+func (loader *htmlReportAssetLoader) copy(name string) (template.URL, error) {
+	relPath := filepath.Join(htmlReportAssetsDirName, name)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(loader.reportDir, relPath)), 0755); err != nil {
+		return "", err
+	}
+	if err := copyFile(filepath.Join(loader.assetsPath, name), filepath.Join(loader.reportDir, relPath)); err != nil {
+		return "", err
+	}
+	return template.URL((&url.URL{Path: filepath.ToSlash(relPath)}).String()), nil
+}
+
+// readFileEnd reads the file's last limit bytes, the truncated content starts with a "..." line.
+func readFileEnd(pth string, limit int64) ([]byte, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= limit {
+		return ioutil.ReadAll(file)
+	}
+
+	if _, err := file.Seek(info.Size()-limit, io.SeekStart); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(file, limit))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("...\n"), content...), nil
+}
+
+// copyFile copies the src file to the dst path.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := in.Close(); closeErr != nil {
+			log.Printf("Failed to close file (%s): %s", src, closeErr)
+		}
+	}()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// writeHTMLReport writes the HTML report of the summary into the given directory and returns its path.
+func writeHTMLReport(summary *ResultsSummary, dir string) (string, error) {
+	var content bytes.Buffer
+	if err := htmlReportTemplate.Execute(&content, createHTMLReport(summary, dir)); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	reportPath := filepath.Join(dir, htmlReportFileName)
+	if err := ioutil.WriteFile(reportPath, content.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return reportPath, nil
+}
+
+// htmlReportTemplate renders a single file report, without external CSS or JS.
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Firebase TestLab results</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 24px; color: #222; background: #f6f6f6; }
+table { border-collapse: collapse; background: #fff; }
+th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; }
+.card { background: #fff; border: 1px solid #ddd; border-left-width: 6px; border-radius: 4px; margin: 12px 0; padding: 8px 16px; }
+.tag { font-size: 12px; font-weight: normal; border: 1px solid #999; border-radius: 8px; padding: 0 6px; color: #666; }
+.outcome { font-weight: bold; text-transform: uppercase; }
+.success { color: #2e7d32; border-left-color: #2e7d32; }
+.flaky { color: #8e24aa; border-left-color: #8e24aa; }
+.skipped { color: #1565c0; border-left-color: #1565c0; }
+.inconclusive { color: #f9a825; border-left-color: #f9a825; }
+.failure { color: #c62828; border-left-color: #c62828; }
+.card h3, .card p, .card li { color: #222; }
+pre { background: #f0f0f0; padding: 8px; overflow-x: auto; max-height: 400px; }
+img, video { max-width: 320px; max-height: 480px; margin: 4px; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>Firebase TestLab results</h1>
+<p>Outcome: {{if .Summary.Outcome}}<span class="outcome {{.Summary.Outcome}}">{{.Summary.Outcome}}</span>{{else}}no results{{end}}
+{{if .Summary.Successful}}(passed){{else}}(failed){{end}}</p>
+
+<h2>Matrices</h2>
+<table>
+<tr><th>Name</th><th>Test type</th><th>State</th><th>Devices</th><th>Attempts</th></tr>
+{{range .Summary.Matrices}}<tr><td>{{.Name}}</td><td>{{.TestType}}</td><td>{{.State}}</td><td>{{.Devices}}</td><td>{{.Attempts}}</td></tr>
+{{end}}</table>
+
+<h2>Outcomes</h2>
+<table>
+<tr>{{range $outcome, $count := .Summary.Counts}}<th class="{{$outcome}}">{{$outcome}}</th>{{end}}</tr>
+<tr>{{range $outcome, $count := .Summary.Counts}}<td>{{$count}}</td>{{end}}</tr>
+</table>
+
+<h2>Devices</h2>
+{{range .Devices}}<div class="card {{.Outcome}}">
+<h3>{{.Name}}{{if .Optional}} <span class="tag">optional</span>{{end}}</h3>
+<p>{{.TestType}}{{if .Matrix}} &middot; {{.Matrix}}{{end}} &middot; <span class="outcome {{.Outcome}}">{{.Outcome}}</span>
+{{range .Details}} <code>{{.}}</code>{{end}}
+&middot; {{printf "%.0f" .DurationSeconds}}s{{if .TestCount}} &middot; {{.TestCount}} tests{{end}}</p>
+{{if gt (len .Attempts) 1}}<p>Attempts: {{range $i, $attempt := .Attempts}}{{if $i}} &rarr; {{end}}{{$attempt}}{{end}}</p>{{end}}
+{{if .FailedTests}}<h4>Failing tests</h4>
+<ul>{{range .FailedTests}}<li><code>{{.ClassName}}#{{.Name}}</code> ({{.Status}}){{if .StackTrace}}<pre>{{.StackTrace}}</pre>{{end}}</li>
+{{end}}</ul>{{end}}
+{{if .Assets}}<h4>Assets</h4>
+{{template "assets" .Assets}}{{end}}
+</div>
+{{end}}
+
+{{if .Assets}}<h2>Assets</h2>
+{{template "assets" .Assets}}{{end}}
+</body>
+</html>
+{{define "assets"}}{{range .}}{{if eq .Kind "image"}}<img src="{{.Src}}" alt="{{.Name}}" title="{{.Name}}">
+{{else if eq .Kind "video"}}<video controls src="{{.Src}}" title="{{.Name}}"></video>
+{{else if eq .Kind "text"}}<details><summary>{{.Name}}</summary><pre>{{.Text}}</pre></details>
+{{else if .Src}}<p><a href="{{.Src}}">{{.Name}}</a></p>
+{{else}}<p>{{.Name}}: <code>{{.Path}}</code></p>
+{{end}}{{end}}{{end}}`))
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const junitReportFileName = "firebase_test_results.xml"
+
+// junitReport is the JUnit XML report written from the device results.
+type junitReport struct {
+	XMLName    xml.Name           `xml:"testsuites"`
+	Tests      int                `xml:"tests,attr"`
+	Failures   int                `xml:"failures,attr"`
+	Errors     int                `xml:"errors,attr"`
+	Skipped    int                `xml:"skipped,attr"`
+	Time       string             `xml:"time,attr"`
+	TestSuites []junitReportSuite `xml:"testsuite"`
+}
+
+type junitReportSuite struct {
+	Name       string              `xml:"name,attr"`
+	Tests      int                 `xml:"tests,attr"`
+	Failures   int                 `xml:"failures,attr"`
+	Errors     int                 `xml:"errors,attr"`
+	Skipped    int                 `xml:"skipped,attr"`
+	Time       string              `xml:"time,attr"`
+	Properties []junitReportProp   `xml:"properties>property,omitempty"`
+	TestCases  []junitReportCase   `xml:"testcase"`
+	SystemOut  *junitReportContent `xml:"system-out,omitempty"`
+}
+
+type junitReportProp struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitReportCase struct {
+	Name      string              `xml:"name,attr"`
+	ClassName string              `xml:"classname,attr"`
+	Time      string              `xml:"time,attr,omitempty"`
+	Failure   *junitReportContent `xml:"failure,omitempty"`
+	Error     *junitReportContent `xml:"error,omitempty"`
+	Skipped   *junitReportContent `xml:"skipped,omitempty"`
+}
+
+type junitReportContent struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Content string `xml:",chardata"`
+}
+
+// createJUnitReport returns one testsuite per device. The testcases are the device's test case results if these are
+// reported, otherwise one testcase per shard or game loop scenario, derived from the step's outcome.
+func createJUnitReport(results []*DeviceResult) junitReport {
+	report := junitReport{}
+	totalSeconds := 0.0
+	for _, result := range results {
+		suite := junitReportSuite{Name: deviceName(result)}
+		for _, key := range deviceDimensionKeys {
+			suite.Properties = append(suite.Properties, junitReportProp{Name: key, Value: result.Dimensions[key]})
+		}
+		suite.Properties = append(suite.Properties, junitReportProp{Name: "Group", Value: result.group()})
+		if len(result.History) > 1 {
+			suite.SystemOut = &junitReportContent{Content: "Attempts: " + formatHistory(result.History)}
+		}
+
+		suiteSeconds := 0.0
+		for _, attempts := range groupStepAttempts(result.Steps) {
+			step := attempts[len(attempts)-1]
+			suiteSeconds += step.RunDuration.duration().Seconds()
+			suite.TestCases = append(suite.TestCases, junitStepTestCases(result, step)...)
+		}
+
+		for _, testCase := range suite.TestCases {
+			suite.Tests++
+			switch {
+			case testCase.Failure != nil:
+				suite.Failures++
+			case testCase.Error != nil:
+				suite.Errors++
+			case testCase.Skipped != nil:
+				suite.Skipped++
+			}
+		}
+		suite.Time = formatSeconds(suiteSeconds)
+		totalSeconds += suiteSeconds
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		report.Skipped += suite.Skipped
+		report.TestSuites = append(report.TestSuites, suite)
+	}
+	report.Time = formatSeconds(totalSeconds)
+	return report
+}
+
+// junitStepTestCases returns the step's test case results, extended with a testcase of the step's outcome
+// if the step failed without a failed test case, e.g. the app crashed before the tests.
+func junitStepTestCases(result *DeviceResult, step *Step) []junitReportCase {
+	className := ""
+	if result.matrixRun != nil {
+		className = result.matrixRun.TestType
+	}
+
+	testCases := []junitReportCase{}
+	failedTestCase := false
+	for _, testCase := range step.TestCases {
+		if testCase.TestCaseReference == nil {
+			continue
+		}
+		junitCase := junitReportCase{Name: testCase.TestCaseReference.Name, ClassName: testCase.TestCaseReference.ClassName}
+		if testCase.ElapsedTime != nil {
+			junitCase.Time = formatSeconds(testCase.ElapsedTime.duration().Seconds())
+		}
+		switch testCase.Status {
+		case "failed":
+			junitCase.Failure = &junitReportContent{Message: firstLine(testCase.stackTrace()), Type: "failed", Content: testCase.stackTrace()}
+			failedTestCase = true
+		case "error":
+			junitCase.Error = &junitReportContent{Message: firstLine(testCase.stackTrace()), Type: "error", Content: testCase.stackTrace()}
+			failedTestCase = true
+		case "skipped":
+			junitCase.Skipped = &junitReportContent{Message: testCase.SkippedMessage}
+		}
+		testCases = append(testCases, junitCase)
+	}
+
+	if len(testCases) > 0 && (failedTestCase || step.Outcome == nil || step.Outcome.Summary == "success" || step.Outcome.Summary == "flaky") {
+		return testCases
+	}
+
+	name := className
+	if index := shardIndex(step); index >= 0 {
+		name = fmt.Sprintf("shard %d", index)
+	} else if scenario := stepDimensions(step)["Scenario"]; scenario != "" {
+		name = "scenario " + scenario
+	}
+	stepCase := junitReportCase{Name: name, ClassName: className, Time: formatSeconds(step.RunDuration.duration().Seconds())}
+	if step.Outcome != nil {
+		message := strings.Join(outcomeDetails(step.Outcome), ", ")
+		switch step.Outcome.Summary {
+		case "failure":
+			stepCase.Failure = &junitReportContent{Message: message, Type: step.Outcome.Summary}
+		case "inconclusive":
+			stepCase.Error = &junitReportContent{Message: message, Type: step.Outcome.Summary}
+		case "skipped":
+			stepCase.Skipped = &junitReportContent{Message: message}
+		}
+	}
+	return append(testCases, stepCase)
+}
+
+func firstLine(text string) string {
+	return strings.SplitN(text, "\n", 2)[0]
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// writeJUnitReport writes the JUnit XML report of the results into a temp dir and returns its path.
+func writeJUnitReport(results []*DeviceResult) (string, error) {
+	content, err := xml.MarshalIndent(createJUnitReport(results), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_junit_report")
+	if err != nil {
+		return "", err
+	}
+
+	reportPath := filepath.Join(tempDir, junitReportFileName)
+	if err := ioutil.WriteFile(reportPath, append([]byte(xml.Header), content...), 0644); err != nil {
+		return "", err
+	}
+	return reportPath, nil
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,17 +10,14 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/tabwriter"
-	"time"
 
-	"github.com/bitrise-io/go-utils/colorstring"
 	"github.com/bitrise-io/go-utils/log"
-	"github.com/bitrise-io/go-utils/pathutil"
 	"github.com/bitrise-io/go-utils/sliceutil"
 	"github.com/bitrise-tools/go-steputils/input"
-	"github.com/bitrise-tools/go-steputils/tools"
 )
 
 // ConfigsModel ...
@@ -30,6 +27,8 @@ type ConfigsModel struct {
 	BuildSlug  string
 	AppSlug    string
 	APIToken   string
+	DeployDir  string
+	BuildURL   string
 
 	// shared
 	ApkPath              string
@@ -41,21 +40,53 @@ type ConfigsModel struct {
 	DownloadTestResults  string
 	DirectoriesToPull    string
 	EnvironmentVariables string
+	AutoGoogleLogin      string
+	RecordVideo          string
+	PerformanceMetrics   string
+	FlakyTestAttempts    string
+	FlakyTestPolicy      string
+	RerunAttempts        string
+	RerunFailedTestsOnly string
+	MinTestCount         string
+	FailurePolicy        string
+	MaxFailedPercent     string
+	OptionalDevices      string
+	AdditionalApks       string
+	FilesToPush          string
 
 	// instrumentation
-	InstTestPackageID   string
-	InstTestRunnerClass string
-	InstTestTargets     string
+	InstTestPackageID     string
+	InstTestRunnerClass   string
+	InstTestTargets       string
+	InstUseOrchestrator   string
+	InstClearPackageData  string
+	InstRunnerArguments   string
+	InstNumUniformShards  string
+	InstManualShards      string
+	InstNumBalancedShards string
+	InstShardHistoryDir   string
+	InstTestClassPattern  string
 
 	// robo
-	RoboInitialActivity string
-	RoboMaxDepth        string
-	RoboMaxSteps        string
-	RoboDirectives      string
+	RoboInitialActivity  string
+	RoboMaxDepth         string
+	RoboMaxSteps         string
+	RoboDirectives       string
+	RoboScriptPath       string
+	RoboUsernameResource string
+	RoboUsername         string
+	RoboPasswordResource string
+	RoboPassword         string
 
 	// loop
 	LoopScenarios      string
 	LoopScenarioLabels string
+	LoopObbFiles       string
+
+	// ios xctest
+	XcTestZipPath string
+	XcTestRunPath string
+	XcodeVersion  string
 }
 
 // ListStepsResponse ...
@@ -63,6 +94,12 @@ type ListStepsResponse struct {
 	Steps []*Step `json:"steps,omitempty"`
 }
 
+// ListTestCasesResponse is a page of a step's test cases.
+type ListTestCasesResponse struct {
+	TestCases     []*TestCase `json:"testCases,omitempty"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
 // Outcome ...
 type Outcome struct {
 	FailureDetail      *FailureDetail      `json:"failureDetail,omitempty"`
@@ -101,9 +138,62 @@ type InconclusiveDetail struct {
 
 // Step ...
 type Step struct {
+	StepID         string                     `json:"stepId,omitempty"`
 	Outcome        *Outcome                   `json:"outcome,omitempty"`
 	State          string                     `json:"state,omitempty"`
 	DimensionValue []*StepDimensionValueEntry `json:"dimensionValue,omitempty"`
+	RunDuration    *Duration                  `json:"runDuration,omitempty"`
+	MultiStep      *MultiStep                 `json:"multiStep,omitempty"`
+	TestCases      []*TestCase                `json:"testCases,omitempty"`
+	TestExecution  *TestExecutionStep         `json:"testExecutionStep,omitempty"`
+}
+
+// TestExecutionStep ...
+type TestExecutionStep struct {
+	TestSuiteOverviews []*TestSuiteOverview `json:"testSuiteOverviews,omitempty"`
+}
+
+// TestSuiteOverview ...
+type TestSuiteOverview struct {
+	Name         string `json:"name,omitempty"`
+	TotalCount   int    `json:"totalCount,omitempty"`
+	FailureCount int    `json:"failureCount,omitempty"`
+	ErrorCount   int    `json:"errorCount,omitempty"`
+	SkippedCount int    `json:"skippedCount,omitempty"`
+	FlakyCount   int    `json:"flakyCount,omitempty"`
+}
+
+// TestCase ...
+type TestCase struct {
+	TestCaseID        string             `json:"testCaseId,omitempty"`
+	Status            string             `json:"status,omitempty"`
+	TestCaseReference *TestCaseReference `json:"testCaseReference,omitempty"`
+	ElapsedTime       *Duration          `json:"elapsedTime,omitempty"`
+	StackTraces       []*StackTrace      `json:"stackTraces,omitempty"`
+	SkippedMessage    string             `json:"skippedMessage,omitempty"`
+}
+
+// TestCaseReference ...
+type TestCaseReference struct {
+	Name          string `json:"name,omitempty"`
+	ClassName     string `json:"className,omitempty"`
+	TestSuiteName string `json:"testSuiteName,omitempty"`
+}
+
+// StackTrace ...
+type StackTrace struct {
+	Exception string `json:"exception,omitempty"`
+}
+
+// MultiStep ...
+type MultiStep struct {
+	MultistepNumber int64 `json:"multistepNumber,omitempty"`
+}
+
+// Duration ...
+type Duration struct {
+	Seconds int64 `json:"seconds,string,omitempty"`
+	Nanos   int32 `json:"nanos,omitempty"`
 }
 
 // StepDimensionValueEntry ...
@@ -125,14 +215,29 @@ type AndroidDeviceList struct {
 	AndroidDevices []*AndroidDevice `json:"androidDevices,omitempty"`
 }
 
+// IosDevice ...
+type IosDevice struct {
+	IosModelID   string `json:"iosModelId,omitempty"`
+	IosVersionID string `json:"iosVersionId,omitempty"`
+	Locale       string `json:"locale,omitempty"`
+	Orientation  string `json:"orientation,omitempty"`
+}
+
+// IosDeviceList ...
+type IosDeviceList struct {
+	IosDevices []*IosDevice `json:"iosDevices,omitempty"`
+}
+
 // EnvironmentMatrix ...
 type EnvironmentMatrix struct {
 	AndroidDeviceList *AndroidDeviceList `json:"androidDeviceList,omitempty"`
+	IosDeviceList     *IosDeviceList     `json:"iosDeviceList,omitempty"`
 }
 
 // TestMatrix ...
 type TestMatrix struct {
 	EnvironmentMatrix *EnvironmentMatrix `json:"environmentMatrix,omitempty"`
+	FlakyTestAttempts int64              `json:"flakyTestAttempts,omitempty"`
 	TestSpecification *TestSpecification `json:"testSpecification,omitempty"`
 }
 
@@ -141,26 +246,56 @@ type TestSpecification struct {
 	AndroidInstrumentationTest *AndroidInstrumentationTest `json:"androidInstrumentationTest,omitempty"`
 	AndroidRoboTest            *AndroidRoboTest            `json:"androidRoboTest,omitempty"`
 	AndroidTestLoop            *AndroidTestLoop            `json:"androidTestLoop,omitempty"`
+	IosXcTest                  *IosXcTest                  `json:"iosXcTest,omitempty"`
 	AutoGoogleLogin            bool                        `json:"autoGoogleLogin,omitempty"`
+	DisablePerformanceMetrics  bool                        `json:"disablePerformanceMetrics,omitempty"`
+	DisableVideoRecording      bool                        `json:"disableVideoRecording,omitempty"`
 	TestSetup                  *TestSetup                  `json:"testSetup,omitempty"`
 	TestTimeout                string                      `json:"testTimeout,omitempty"`
 }
 
 // AndroidInstrumentationTest ...
 type AndroidInstrumentationTest struct {
-	AppPackageID    string   `json:"appPackageId,omitempty"`
-	TestPackageID   string   `json:"testPackageId,omitempty"`
-	TestRunnerClass string   `json:"testRunnerClass,omitempty"`
-	TestTargets     []string `json:"testTargets,omitempty"`
+	AppBundle          *AppBundle      `json:"appBundle,omitempty"`
+	AppPackageID       string          `json:"appPackageId,omitempty"`
+	TestApk            *FileReference  `json:"testApk,omitempty"`
+	TestPackageID      string          `json:"testPackageId,omitempty"`
+	TestRunnerClass    string          `json:"testRunnerClass,omitempty"`
+	TestTargets        []string        `json:"testTargets,omitempty"`
+	OrchestratorOption string          `json:"orchestratorOption,omitempty"`
+	ShardingOption     *ShardingOption `json:"shardingOption,omitempty"`
+}
+
+// ShardingOption ...
+type ShardingOption struct {
+	ManualSharding  *ManualSharding  `json:"manualSharding,omitempty"`
+	UniformSharding *UniformSharding `json:"uniformSharding,omitempty"`
+}
+
+// UniformSharding ...
+type UniformSharding struct {
+	NumShards int64 `json:"numShards,omitempty"`
+}
+
+// ManualSharding ...
+type ManualSharding struct {
+	TestTargetsForShard []*TestTargetsForShard `json:"testTargetsForShard,omitempty"`
+}
+
+// TestTargetsForShard ...
+type TestTargetsForShard struct {
+	TestTargets []string `json:"testTargets,omitempty"`
 }
 
 // AndroidRoboTest ...
 type AndroidRoboTest struct {
 	AppInitialActivity string           `json:"appInitialActivity,omitempty"`
+	AppBundle          *AppBundle       `json:"appBundle,omitempty"`
 	AppPackageID       string           `json:"appPackageId,omitempty"`
 	MaxDepth           int64            `json:"maxDepth,omitempty"`
 	MaxSteps           int64            `json:"maxSteps,omitempty"`
 	RoboDirectives     []*RoboDirective `json:"roboDirectives,omitempty"`
+	RoboScript         *FileReference   `json:"roboScript,omitempty"`
 }
 
 // RoboDirective ...
@@ -172,18 +307,57 @@ type RoboDirective struct {
 
 // AndroidTestLoop ...
 type AndroidTestLoop struct {
-	AppPackageID   string   `json:"appPackageId,omitempty"`
-	ScenarioLabels []string `json:"scenarioLabels,omitempty"`
-	Scenarios      []int64  `json:"scenarios,omitempty"`
+	AppBundle      *AppBundle `json:"appBundle,omitempty"`
+	AppPackageID   string     `json:"appPackageId,omitempty"`
+	ScenarioLabels []string   `json:"scenarioLabels,omitempty"`
+	Scenarios      []int64    `json:"scenarios,omitempty"`
+}
+
+// IosXcTest ...
+type IosXcTest struct {
+	TestsZip     *FileReference `json:"testsZip,omitempty"`
+	Xctestrun    *FileReference `json:"xctestrun,omitempty"`
+	XcodeVersion string         `json:"xcodeVersion,omitempty"`
 }
 
 // TestSetup ...
 type TestSetup struct {
+	AdditionalApks       []*Apk                 `json:"additionalApks,omitempty"`
 	DirectoriesToPull    []string               `json:"directoriesToPull,omitempty"`
 	EnvironmentVariables []*EnvironmentVariable `json:"environmentVariables,omitempty"`
+	FilesToPush          []*DeviceFile          `json:"filesToPush,omitempty"`
 	NetworkProfile       string                 `json:"networkProfile,omitempty"`
 }
 
+// FileReference ...
+type FileReference struct {
+	GcsPath string `json:"gcsPath,omitempty"`
+}
+
+// Apk ...
+type Apk struct {
+	Location    *FileReference `json:"location,omitempty"`
+	PackageName string         `json:"packageName,omitempty"`
+}
+
+// DeviceFile ...
+type DeviceFile struct {
+	ObbFile     *ObbFile     `json:"obbFile,omitempty"`
+	RegularFile *RegularFile `json:"regularFile,omitempty"`
+}
+
+// ObbFile ...
+type ObbFile struct {
+	Obb         *FileReference `json:"obb,omitempty"`
+	ObbFileName string         `json:"obbFileName,omitempty"`
+}
+
+// RegularFile ...
+type RegularFile struct {
+	Content    *FileReference `json:"content,omitempty"`
+	DevicePath string         `json:"devicePath,omitempty"`
+}
+
 // EnvironmentVariable ...
 type EnvironmentVariable struct {
 	Key   string `json:"key,omitempty"`
@@ -192,8 +366,39 @@ type EnvironmentVariable struct {
 
 // UploadURLRequest ...
 type UploadURLRequest struct {
-	AppURL     string `json:"appUrl"`
-	TestAppURL string `json:"testAppUrl"`
+	AppURL          string            `json:"appUrl"`
+	AppGcsPath      string            `json:"appGcsPath,omitempty"`
+	TestAppURL      string            `json:"testAppUrl"`
+	AdditionalFiles []*AdditionalFile `json:"additionalFiles,omitempty"`
+}
+
+// AssetsUploadRequest ...
+type AssetsUploadRequest struct {
+	AppType         string   `json:"appType,omitempty"`
+	AdditionalFiles []string `json:"additionalFiles,omitempty"`
+}
+
+// AppBundle ...
+type AppBundle struct {
+	BundleLocation *FileReference `json:"bundleLocation,omitempty"`
+}
+
+// AdditionalFile ...
+type AdditionalFile struct {
+	Name      string `json:"name"`
+	UploadURL string `json:"uploadUrl"`
+	GcsPath   string `json:"gcsPath"`
+}
+
+// FileToPush ...
+type FileToPush struct {
+	LocalPath  string
+	DevicePath string
+}
+
+// isObb returns true if the file has to be pushed as an OBB file, these have no explicit device path.
+func (file FileToPush) isObb() bool {
+	return file.DevicePath == ""
 }
 
 func createConfigsModelFromEnvs() ConfigsModel {
@@ -203,6 +408,8 @@ func createConfigsModelFromEnvs() ConfigsModel {
 		BuildSlug:  os.Getenv("BITRISE_BUILD_SLUG"),
 		AppSlug:    os.Getenv("BITRISE_APP_SLUG"),
 		APIToken:   os.Getenv("api_token"),
+		DeployDir:  os.Getenv("BITRISE_DEPLOY_DIR"),
+		BuildURL:   os.Getenv("BITRISE_BUILD_URL"),
 
 		// shared
 		ApkPath:              os.Getenv("apk_path"),
@@ -214,34 +421,86 @@ func createConfigsModelFromEnvs() ConfigsModel {
 		DownloadTestResults:  os.Getenv("download_test_results"),
 		DirectoriesToPull:    os.Getenv("directories_to_pull"),
 		EnvironmentVariables: os.Getenv("environment_variables"),
+		AutoGoogleLogin:      os.Getenv("auto_google_login"),
+		RecordVideo:          os.Getenv("record_video"),
+		PerformanceMetrics:   os.Getenv("performance_metrics"),
+		FlakyTestAttempts:    os.Getenv("flaky_test_attempts"),
+		FlakyTestPolicy:      os.Getenv("flaky_test_policy"),
+		RerunAttempts:        os.Getenv("rerun_attempts"),
+		RerunFailedTestsOnly: os.Getenv("rerun_failed_tests_only"),
+		MinTestCount:         os.Getenv("min_test_count"),
+		FailurePolicy:        os.Getenv("failure_policy"),
+		MaxFailedPercent:     os.Getenv("max_failed_devices_percent"),
+		OptionalDevices:      os.Getenv("optional_devices"),
+		AdditionalApks:       os.Getenv("additional_apks"),
+		FilesToPush:          os.Getenv("files_to_push"),
 
 		// instrumentation
-		InstTestPackageID:   os.Getenv("inst_test_package_id"),
-		InstTestRunnerClass: os.Getenv("inst_test_runner_class"),
-		InstTestTargets:     os.Getenv("inst_test_targets"),
+		InstTestPackageID:     os.Getenv("inst_test_package_id"),
+		InstTestRunnerClass:   os.Getenv("inst_test_runner_class"),
+		InstTestTargets:       os.Getenv("inst_test_targets"),
+		InstUseOrchestrator:   os.Getenv("inst_use_orchestrator"),
+		InstClearPackageData:  os.Getenv("inst_clear_package_data"),
+		InstRunnerArguments:   os.Getenv("inst_runner_arguments"),
+		InstNumUniformShards:  os.Getenv("inst_num_uniform_shards"),
+		InstManualShards:      os.Getenv("inst_manual_shards"),
+		InstNumBalancedShards: os.Getenv("inst_num_balanced_shards"),
+		InstShardHistoryDir:   os.Getenv("inst_shard_history_dir"),
+		InstTestClassPattern:  os.Getenv("inst_test_class_pattern"),
 
 		// robo
-		RoboInitialActivity: os.Getenv("robo_initial_activity"),
-		RoboMaxDepth:        os.Getenv("robo_max_depth"),
-		RoboMaxSteps:        os.Getenv("robo_max_steps"),
-		RoboDirectives:      os.Getenv("robo_directives"),
+		RoboInitialActivity:  os.Getenv("robo_initial_activity"),
+		RoboMaxDepth:         os.Getenv("robo_max_depth"),
+		RoboMaxSteps:         os.Getenv("robo_max_steps"),
+		RoboDirectives:       os.Getenv("robo_directives"),
+		RoboScriptPath:       os.Getenv("robo_script_path"),
+		RoboUsernameResource: os.Getenv("robo_username_resource"),
+		RoboUsername:         os.Getenv("robo_username"),
+		RoboPasswordResource: os.Getenv("robo_password_resource"),
+		RoboPassword:         os.Getenv("robo_password"),
 
 		// loop
 		LoopScenarios:      os.Getenv("loop_scenarios"),
 		LoopScenarioLabels: os.Getenv("loop_scenario_labels"),
+		LoopObbFiles:       os.Getenv("loop_obb_files"),
+
+		XcTestZipPath: os.Getenv("xctest_zip_path"),
+		XcTestRunPath: os.Getenv("xctestrun_path"),
+		XcodeVersion:  os.Getenv("xcode_version"),
 	}
 }
 
 func (configs ConfigsModel) print() {
 	log.Infof("Configs:")
-	log.Printf("- ApkPath: %s", configs.ApkPath)
+	if !configs.hasTestType("ios_xctest") {
+		log.Printf("- ApkPath: %s", configs.ApkPath)
+		log.Printf("- AppType: %s", detectAppType(configs.ApkPath))
+	}
 
 	log.Printf("- TestTimeout: %s", configs.TestTimeout)
+	log.Printf("- DownloadTestResults: %s", configs.DownloadTestResults)
 	log.Printf("- DirectoriesToPull: %s", configs.DirectoriesToPull)
 	log.Printf("- EnvironmentVariables: %s", configs.EnvironmentVariables)
+	log.Printf("- AutoGoogleLogin: %s", configs.AutoGoogleLogin)
+	log.Printf("- RecordVideo: %s", configs.RecordVideo)
+	log.Printf("- PerformanceMetrics: %s", configs.PerformanceMetrics)
+	log.Printf("- FlakyTestAttempts: %s", configs.FlakyTestAttempts)
+	log.Printf("- FlakyTestPolicy: %s", configs.FlakyTestPolicy)
+	log.Printf("- RerunAttempts: %s", configs.RerunAttempts)
+	log.Printf("- RerunFailedTestsOnly: %s", configs.RerunFailedTestsOnly)
+	log.Printf("- MinTestCount: %s", configs.MinTestCount)
+	log.Printf("- FailurePolicy: %s", configs.FailurePolicy)
+	log.Printf("- MaxFailedPercent: %s", configs.MaxFailedPercent)
+	log.Printf("- OptionalDevices: %s", configs.OptionalDevices)
+	log.Printf("- AdditionalApks: %s", configs.AdditionalApks)
+	log.Printf("- FilesToPush: %s", configs.FilesToPush)
 	log.Printf("- TestDevices:\n---")
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "Model\tAPI Level\tLocale\tOrientation\t")
+	if configs.hasTestType("ios_xctest") {
+		fmt.Fprintln(w, "Model\tiOS Version\tLocale\tOrientation\tGroup\t")
+	} else {
+		fmt.Fprintln(w, "Model\tAPI Level\tLocale\tOrientation\tGroup\t")
+	}
 	scanner := bufio.NewScanner(strings.NewReader(configs.TestDevices))
 	for scanner.Scan() {
 		device := scanner.Text()
@@ -250,13 +509,12 @@ func (configs ConfigsModel) print() {
 			continue
 		}
 
-		deviceParams := strings.Split(device, ",")
-
-		if len(deviceParams) != 4 {
+		deviceParams, group, err := parseTestDevice(device)
+		if err != nil {
 			continue
 		}
 
-		fmt.Fprintln(w, fmt.Sprintf("%s\t%s\t%s\t%s\t", deviceParams[0], deviceParams[1], deviceParams[3], deviceParams[2]))
+		fmt.Fprintln(w, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t", deviceParams[0], deviceParams[1], deviceParams[3], deviceParams[2], group))
 	}
 	w.Flush()
 	log.Printf("---")
@@ -264,25 +522,45 @@ func (configs ConfigsModel) print() {
 	log.Printf("- TestType: %s", configs.TestType)
 
 	// instruments
-	if configs.TestType == "instrumentation" {
+	if configs.hasTestType("instrumentation") {
 		log.Printf("- TestApkPath: %s", configs.TestApkPath)
 		log.Printf("- InstTestPackageID: %s", configs.InstTestPackageID)
 		log.Printf("- InstTestRunnerClass: %s", configs.InstTestRunnerClass)
 		log.Printf("- InstTestTargets: %s", configs.InstTestTargets)
+		log.Printf("- InstUseOrchestrator: %s", configs.InstUseOrchestrator)
+		log.Printf("- InstClearPackageData: %s", configs.InstClearPackageData)
+		log.Printf("- InstRunnerArguments: %s", configs.InstRunnerArguments)
+		log.Printf("- InstNumUniformShards: %s", configs.InstNumUniformShards)
+		log.Printf("- InstManualShards: %s", configs.InstManualShards)
+		log.Printf("- InstNumBalancedShards: %s", configs.InstNumBalancedShards)
+		log.Printf("- InstShardHistoryDir: %s", configs.InstShardHistoryDir)
+		log.Printf("- InstTestClassPattern: %s", configs.InstTestClassPattern)
 	}
 
 	//robo
-	if configs.TestType == "robo" {
+	if configs.hasTestType("robo") {
 		log.Printf("- RoboInitialActivity: %s", configs.RoboInitialActivity)
 		log.Printf("- RoboMaxDepth: %s", configs.RoboMaxDepth)
 		log.Printf("- RoboMaxSteps: %s", configs.RoboMaxSteps)
 		log.Printf("- RoboDirectives: %s", configs.RoboDirectives)
+		log.Printf("- RoboScriptPath: %s", configs.RoboScriptPath)
+		log.Printf("- RoboUsernameResource: %s", configs.RoboUsernameResource)
+		log.Printf("- RoboUsername: %s", configs.RoboUsername)
+		log.Printf("- RoboPasswordResource: %s", configs.RoboPasswordResource)
+		log.Printf("- RoboPassword: %s", input.SecureInput(configs.RoboPassword))
 	}
 
-	if configs.TestType == "gameloop" {
+	if configs.hasTestType("gameloop") {
 		// loop
 		log.Printf("- LoopScenarios: %s", configs.LoopScenarios)
 		log.Printf("- LoopScenarioLabels: %s", configs.LoopScenarioLabels)
+		log.Printf("- LoopObbFiles: %s", configs.LoopObbFiles)
+	}
+
+	if configs.hasTestType("ios_xctest") {
+		log.Printf("- XcTestZipPath: %s", configs.XcTestZipPath)
+		log.Printf("- XcTestRunPath: %s", configs.XcTestRunPath)
+		log.Printf("- XcodeVersion: %s", configs.XcodeVersion)
 	}
 }
 
@@ -303,459 +581,644 @@ func (configs ConfigsModel) validate() error {
 	if err := input.ValidateIfNotEmpty(configs.TestType); err != nil {
 		return fmt.Errorf("Issue with TestType: %s", err)
 	}
-	if err := input.ValidateWithOptions(configs.TestType, "instrumentation", "robo", "gameloop"); err != nil {
-		return fmt.Errorf("Issue with TestType: %s", err)
+	testTypes := configs.testTypes()
+	for _, testType := range testTypes {
+		if err := input.ValidateWithOptions(testType, "instrumentation", "robo", "gameloop", "ios_xctest"); err != nil {
+			return fmt.Errorf("Issue with TestType: %s", err)
+		}
 	}
-	if err := input.ValidateIfNotEmpty(configs.ApkPath); err != nil {
-		return fmt.Errorf("Issue with ApkPath: %s", err)
+	if len(testTypes) == 0 {
+		return fmt.Errorf("Issue with TestType: parameter not specified")
 	}
-	if err := input.ValidateIfPathExists(configs.ApkPath); err != nil {
-		return fmt.Errorf("Issue with ApkPath: %s", err)
+	for i, testType := range testTypes {
+		if sliceutil.IndexOfStringInSlice(testType, testTypes) != i {
+			return fmt.Errorf("Issue with TestType: test type (%s) specified more than once", testType)
+		}
 	}
-	if configs.TestType == "instrumentation" {
+	if configs.hasTestType("ios_xctest") {
+		if len(testTypes) > 1 {
+			return fmt.Errorf("Issue with TestType: ios_xctest can not be combined with Android test types")
+		}
+		if err := input.ValidateIfNotEmpty(configs.XcTestZipPath); err != nil {
+			return fmt.Errorf("Issue with XcTestZipPath: %s", err)
+		}
+		if err := input.ValidateIfPathExists(configs.XcTestZipPath); err != nil {
+			return fmt.Errorf("Issue with XcTestZipPath: %s", err)
+		}
+		if configs.XcTestRunPath != "" {
+			if err := input.ValidateIfPathExists(configs.XcTestRunPath); err != nil {
+				return fmt.Errorf("Issue with XcTestRunPath: %s", err)
+			}
+			if filepath.Ext(configs.XcTestRunPath) != ".xctestrun" {
+				return fmt.Errorf("Issue with XcTestRunPath: not an xctestrun file: %s", configs.XcTestRunPath)
+			}
+		}
+		if err := validateXcTestZip(configs.XcTestZipPath, configs.XcTestRunPath != ""); err != nil {
+			return fmt.Errorf("Issue with XcTestZipPath: %s", err)
+		}
+		if configs.AdditionalApks != "" {
+			return fmt.Errorf("Issue with AdditionalApks: not supported by ios_xctest")
+		}
+		if configs.FilesToPush != "" {
+			return fmt.Errorf("Issue with FilesToPush: not supported by ios_xctest")
+		}
+		if configs.DirectoriesToPull != "" {
+			return fmt.Errorf("Issue with DirectoriesToPull: not supported by ios_xctest")
+		}
+		if configs.EnvironmentVariables != "" {
+			return fmt.Errorf("Issue with EnvironmentVariables: not supported by ios_xctest")
+		}
+		if configs.AutoGoogleLogin == "true" {
+			return fmt.Errorf("Issue with AutoGoogleLogin: not supported by ios_xctest")
+		}
+	} else {
+		if err := input.ValidateIfNotEmpty(configs.ApkPath); err != nil {
+			return fmt.Errorf("Issue with ApkPath: %s", err)
+		}
+		if err := input.ValidateIfPathExists(configs.ApkPath); err != nil {
+			return fmt.Errorf("Issue with ApkPath: %s", err)
+		}
+		if detectAppType(configs.ApkPath) == appTypeBundle {
+			if err := validateAppBundle(configs.ApkPath); err != nil {
+				return fmt.Errorf("Issue with ApkPath: %s", err)
+			}
+		}
+	}
+	if configs.hasTestType("instrumentation") {
 		if err := input.ValidateIfNotEmpty(configs.TestApkPath); err != nil {
 			return fmt.Errorf("Issue with TestApkPath: %s", err)
 		}
-		if err := input.ValidateIfPathExists(configs.TestApkPath); err != nil {
+		testApkPaths, err := configs.testApkPaths()
+		if err != nil {
 			return fmt.Errorf("Issue with TestApkPath: %s", err)
 		}
+		testApkNames := map[string]string{}
+		for _, testApkPath := range testApkPaths {
+			if err := input.ValidateIfPathExists(testApkPath); err != nil {
+				return fmt.Errorf("Issue with TestApkPath: %s", err)
+			}
+			// the test APKs are uploaded by their file names
+			name := filepath.Base(testApkPath)
+			if otherPath, ok := testApkNames[name]; ok {
+				return fmt.Errorf("Issue with TestApkPath: test APKs (%s) and (%s) have the same file name", otherPath, testApkPath)
+			}
+			testApkNames[name] = testApkPath
+		}
+		if err := input.ValidateWithOptions(configs.InstUseOrchestrator, "false", "true"); err != nil {
+			return fmt.Errorf("Issue with InstUseOrchestrator: %s", err)
+		}
+		if err := input.ValidateWithOptions(configs.InstClearPackageData, "false", "true"); err != nil {
+			return fmt.Errorf("Issue with InstClearPackageData: %s", err)
+		}
+		if configs.InstUseOrchestrator == "true" {
+			for _, testApkPath := range testApkPaths {
+				if err := validateOrchestratorCompatibility(testApkPath, configs.InstTestRunnerClass); err != nil {
+					return fmt.Errorf("Issue with InstUseOrchestrator: %s", err)
+				}
+			}
+		} else if configs.InstClearPackageData == "true" {
+			return fmt.Errorf("Issue with InstClearPackageData: clearing package data requires Android Test Orchestrator, set inst_use_orchestrator to true")
+		}
+		runnerArguments, err := parseRunnerArguments(configs.InstRunnerArguments)
+		if err != nil {
+			return fmt.Errorf("Issue with InstRunnerArguments: %s", err)
+		}
+		for _, argument := range runnerArguments {
+			for _, env := range parseLines(configs.EnvironmentVariables) {
+				if strings.HasPrefix(env, argument.Key+"=") {
+					return fmt.Errorf("Issue with InstRunnerArguments: argument (%s) is also set in the environment variables", argument.Key)
+				}
+			}
+		}
+		if configs.InstNumUniformShards != "" {
+			if configs.InstManualShards != "" {
+				return fmt.Errorf("Issue with InstNumUniformShards: uniform and manual sharding can not be used together")
+			}
+			numShards, err := strconv.Atoi(configs.InstNumUniformShards)
+			if err != nil {
+				return fmt.Errorf("Issue with InstNumUniformShards: failed to parse string(%s) to integer, error: %s", configs.InstNumUniformShards, err)
+			}
+			if numShards < 1 || numShards > maxNumShards {
+				return fmt.Errorf("Issue with InstNumUniformShards: has to be between 1 and %d", maxNumShards)
+			}
+		}
+		if configs.InstManualShards != "" {
+			if configs.InstTestTargets != "" {
+				return fmt.Errorf("Issue with InstManualShards: test targets are given per shard, inst_test_targets can not be used with manual sharding")
+			}
+			shards := parseManualShards(configs.InstManualShards)
+			if len(shards) > maxNumShards {
+				return fmt.Errorf("Issue with InstManualShards: at most %d shards are allowed, got: %d", maxNumShards, len(shards))
+			}
+			for i, targets := range shards {
+				if len(targets) == 0 {
+					return fmt.Errorf("Issue with InstManualShards: no test target specified for shard %d", i)
+				}
+			}
+		}
+		if configs.InstNumBalancedShards != "" {
+			if configs.InstNumUniformShards != "" || configs.InstManualShards != "" || configs.InstTestTargets != "" {
+				return fmt.Errorf("Issue with InstNumBalancedShards: balanced sharding can not be used together with uniform sharding, manual sharding or test targets")
+			}
+			numShards, err := strconv.Atoi(configs.InstNumBalancedShards)
+			if err != nil {
+				return fmt.Errorf("Issue with InstNumBalancedShards: failed to parse string(%s) to integer, error: %s", configs.InstNumBalancedShards, err)
+			}
+			if numShards < 1 || numShards > maxNumShards {
+				return fmt.Errorf("Issue with InstNumBalancedShards: has to be between 1 and %d", maxNumShards)
+			}
+			if err := input.ValidateIfNotEmpty(configs.InstShardHistoryDir); err != nil {
+				return fmt.Errorf("Issue with InstShardHistoryDir: %s", err)
+			}
+			if _, err := regexp.Compile(configs.InstTestClassPattern); err != nil {
+				return fmt.Errorf("Issue with InstTestClassPattern: %s", err)
+			}
+		}
 	}
-
-	return nil
-}
-
-func failf(f string, v ...interface{}) {
-	log.Errorf(f, v)
-	os.Exit(1)
-}
-
-func main() {
-	configs := createConfigsModelFromEnvs()
-
-	fmt.Println()
-	configs.print()
-
-	if err := configs.validate(); err != nil {
-		failf("%s", err)
+	if err := input.ValidateWithOptions(configs.AutoGoogleLogin, "false", "true"); err != nil {
+		return fmt.Errorf("Issue with AutoGoogleLogin: %s", err)
 	}
-
-	fmt.Println()
-
-	successful := true
-
-	log.Infof("Upload APKs")
-	{
-		url := configs.APIBaseURL + "/assets/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken
-
-		req, err := http.NewRequest("POST", url, nil)
+	if err := input.ValidateWithOptions(configs.RecordVideo, "false", "true"); err != nil {
+		return fmt.Errorf("Issue with RecordVideo: %s", err)
+	}
+	if err := input.ValidateWithOptions(configs.PerformanceMetrics, "false", "true"); err != nil {
+		return fmt.Errorf("Issue with PerformanceMetrics: %s", err)
+	}
+	if configs.FlakyTestAttempts != "" {
+		flakyTestAttempts, err := strconv.Atoi(configs.FlakyTestAttempts)
 		if err != nil {
-			failf("Failed to create http request, error: %s", err)
+			return fmt.Errorf("Issue with FlakyTestAttempts: failed to parse string(%s) to integer, error: %s", configs.FlakyTestAttempts, err)
 		}
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		if flakyTestAttempts < 0 || flakyTestAttempts > maxFlakyTestAttempts {
+			return fmt.Errorf("Issue with FlakyTestAttempts: has to be between 0 and %d", maxFlakyTestAttempts)
+		}
+	}
+	if err := input.ValidateWithOptions(configs.FlakyTestPolicy, flakyPolicySuccess, flakyPolicyWarning, flakyPolicyFailure); err != nil {
+		return fmt.Errorf("Issue with FlakyTestPolicy: %s", err)
+	}
+	if err := input.ValidateWithOptions(configs.downloadTestResultsMode(), downloadTestResultsNever, downloadTestResultsAlways, downloadTestResultsOnFailure); err != nil {
+		return fmt.Errorf("Issue with DownloadTestResults: %s", err)
+	}
+	if configs.RerunAttempts != "" {
+		rerunAttempts, err := strconv.Atoi(configs.RerunAttempts)
 		if err != nil {
-			failf("Failed to get http response, error: %s", err)
+			return fmt.Errorf("Issue with RerunAttempts: failed to parse string(%s) to integer, error: %s", configs.RerunAttempts, err)
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			failf("Failed to get http response, status code: %d", resp.StatusCode)
+		if rerunAttempts < 0 || rerunAttempts > maxRerunAttempts {
+			return fmt.Errorf("Issue with RerunAttempts: has to be between 0 and %d", maxRerunAttempts)
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
+	}
+	if err := input.ValidateWithOptions(configs.RerunFailedTestsOnly, "false", "true"); err != nil {
+		return fmt.Errorf("Issue with RerunFailedTestsOnly: %s", err)
+	}
+	for _, device := range parseLines(configs.TestDevices) {
+		if _, _, err := parseTestDevice(device); err != nil {
+			return fmt.Errorf("Issue with TestDevices: %s", err)
+		}
+	}
+	if configs.hasTestType("robo") {
+		roboDirectives, err := parseRoboDirectives(configs.RoboDirectives)
 		if err != nil {
-			failf("Failed to read response body, error: %s", err)
+			return fmt.Errorf("Issue with RoboDirectives: %s", err)
+		}
+		if (configs.RoboUsernameResource == "") != (configs.RoboUsername == "") {
+			return fmt.Errorf("Issue with RoboUsername: both the username resource name and the username have to be specified")
+		}
+		if (configs.RoboPasswordResource == "") != (configs.RoboPassword == "") {
+			return fmt.Errorf("Issue with RoboPassword: both the password resource name and the password have to be specified")
+		}
+		for _, directive := range roboDirectives {
+			if directive.ResourceName == configs.RoboUsernameResource || directive.ResourceName == configs.RoboPasswordResource {
+				return fmt.Errorf("Issue with RoboDirectives: the sign-in resource (%s) is also specified in the robo directives", directive.ResourceName)
+			}
 		}
+		if configs.RoboScriptPath != "" {
+			if err := validateRoboScript(configs.RoboScriptPath); err != nil {
+				return fmt.Errorf("Issue with RoboScriptPath: %s", err)
+			}
+		}
+	}
+	for _, apkPath := range parseLines(configs.AdditionalApks) {
+		if err := input.ValidateIfPathExists(apkPath); err != nil {
+			return fmt.Errorf("Issue with AdditionalApks: %s", err)
+		}
+	}
+	if configs.hasTestType("gameloop") {
+		if _, err := parseLoopScenarios(configs.LoopScenarios); err != nil {
+			return fmt.Errorf("Issue with LoopScenarios: %s", err)
+		}
+		if _, err := parseLoopScenarioLabels(configs.LoopScenarioLabels); err != nil {
+			return fmt.Errorf("Issue with LoopScenarioLabels: %s", err)
+		}
+		for _, obbPath := range parseLines(configs.LoopObbFiles) {
+			if filepath.Ext(obbPath) != ".obb" {
+				return fmt.Errorf("Issue with LoopObbFiles: not an OBB file: %s", obbPath)
+			}
+		}
+	}
+	filesToPush, err := configs.filesToPush()
+	if err != nil {
+		return fmt.Errorf("Issue with FilesToPush: %s", err)
+	}
+	for _, file := range filesToPush {
+		if err := input.ValidateIfPathExists(file.LocalPath); err != nil {
+			return fmt.Errorf("Issue with FilesToPush: %s", err)
+		}
+		if file.isObb() {
+			if err := validateObbFileName(filepath.Base(file.LocalPath)); err != nil {
+				return fmt.Errorf("Issue with FilesToPush: %s", err)
+			}
+			continue
+		}
+		if err := validateDevicePath(file.DevicePath); err != nil {
+			return fmt.Errorf("Issue with FilesToPush: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// roboDirectiveActionTypes are the action types supported by TestLab, only ENTER_TEXT takes input text.
+var roboDirectiveActionTypes = []string{"ENTER_TEXT", "SINGLE_CLICK", "IGNORE"}
 
-		responseModel := &UploadURLRequest{}
+// roboDirectiveActionTypeAliases are the accepted shorthands of the action types.
+var roboDirectiveActionTypeAliases = map[string]string{"CLICK": "SINGLE_CLICK"}
 
-		err = json.Unmarshal(body, responseModel)
+// parseRoboDirectives parses one "ResourceName,InputText,ActionType" directive per line,
+// fields containing "," have to be quoted, e.g. username,"Doe, John",ENTER_TEXT
+func parseRoboDirectives(value string) ([]*RoboDirective, error) {
+	roboDirectives := []*RoboDirective{}
+	for _, line := range parseLines(value) {
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.FieldsPerRecord = 3
+		reader.TrimLeadingSpace = true
+
+		params, err := reader.Read()
 		if err != nil {
-			failf("Failed to unmarshal response body, error: %s", err)
+			return nil, fmt.Errorf("invalid directive configuration: %s, error: %s", line, err)
 		}
 
-		err = uploadFile(responseModel.AppURL, configs.ApkPath)
-		if err != nil {
-			failf("Failed to upload file(%s) to (%s), error: %s", configs.ApkPath, responseModel.AppURL, err)
+		directive := &RoboDirective{ResourceName: strings.TrimSpace(params[0]), InputText: params[1], ActionType: strings.TrimSpace(params[2])}
+		if actionType, ok := roboDirectiveActionTypeAliases[directive.ActionType]; ok {
+			directive.ActionType = actionType
 		}
-		err = uploadFile(responseModel.TestAppURL, configs.TestApkPath)
-		if err != nil {
-			failf("Failed to upload file(%s) to (%s), error: %s", configs.TestApkPath, responseModel.TestAppURL, err)
+		if directive.ResourceName == "" {
+			return nil, fmt.Errorf("resource name not specified in directive: %s", line)
+		}
+		if !sliceutil.IsStringInSlice(directive.ActionType, roboDirectiveActionTypes) {
+			return nil, fmt.Errorf("invalid action type (%s) in directive: %s, available: %v", directive.ActionType, line, roboDirectiveActionTypes)
+		}
+		if directive.ActionType != "ENTER_TEXT" && directive.InputText != "" {
+			return nil, fmt.Errorf("input text is only allowed for ENTER_TEXT action type, directive: %s", line)
 		}
+		roboDirectives = append(roboDirectives, directive)
+	}
+	return roboDirectives, nil
+}
 
-		log.Donef("=> APKs uploaded")
+// validateRoboScript checks if the recorded Robo script is a JSON file.
+func validateRoboScript(pth string) error {
+	if err := input.ValidateIfPathExists(pth); err != nil {
+		return err
 	}
 
-	fmt.Println()
-	log.Infof("Start test")
-	{
-		url := configs.APIBaseURL + "/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken
-
-		testModel := &TestMatrix{}
-		testModel.EnvironmentMatrix = &EnvironmentMatrix{AndroidDeviceList: &AndroidDeviceList{}}
-		testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices = []*AndroidDevice{}
-
-		scanner := bufio.NewScanner(strings.NewReader(configs.TestDevices))
-		for scanner.Scan() {
-			device := scanner.Text()
-			device = strings.TrimSpace(device)
-			if device == "" {
-				continue
-			}
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return fmt.Errorf("failed to read robo script, error: %s", err)
+	}
+	var script interface{}
+	if err := json.Unmarshal(content, &script); err != nil {
+		return fmt.Errorf("robo script (%s) is not a valid JSON file, error: %s", pth, err)
+	}
+	return nil
+}
 
-			deviceParams := strings.Split(device, ",")
-			if len(deviceParams) != 4 {
-				failf("Invalid test device configuration: %s", device)
-			}
+// maxFlakyTestAttempts is the max number of times TestLab reruns a failed test execution.
+const maxFlakyTestAttempts = 10
 
-			newDevice := AndroidDevice{
-				AndroidModelID:   deviceParams[0],
-				AndroidVersionID: deviceParams[1],
-				Locale:           deviceParams[2],
-				Orientation:      deviceParams[3],
-			}
+// maxRerunAttempts is the max number of times the step reruns the failed devices.
+const maxRerunAttempts = 5
 
-			testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices = append(testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices, &newDevice)
-		}
+// Download test results modes, the legacy true and false values mean always and never.
+const (
+	downloadTestResultsNever     = "never"
+	downloadTestResultsAlways    = "always"
+	downloadTestResultsOnFailure = "on_failure"
+)
 
-		// parse directories to pull
-		scanner = bufio.NewScanner(strings.NewReader(configs.DirectoriesToPull))
-		directoriesToPull := []string{}
-		for scanner.Scan() {
-			path := scanner.Text()
-			path = strings.TrimSpace(path)
-			if path == "" {
-				continue
+// maxNumShards is the max number of shards TestLab allows per device.
+const maxNumShards = 50
+
+// parseManualShards parses one shard per line, the shard's test targets are separated with ",".
+func parseManualShards(value string) [][]string {
+	shards := [][]string{}
+	for _, line := range parseLines(value) {
+		targets := []string{}
+		for _, target := range strings.Split(line, ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				targets = append(targets, target)
 			}
-			directoriesToPull = append(directoriesToPull, path)
 		}
+		shards = append(shards, targets)
+	}
+	return shards
+}
 
-		// parse environment variables
-		scanner = bufio.NewScanner(strings.NewReader(configs.DirectoriesToPull))
-		envs := []*EnvironmentVariable{}
-		for scanner.Scan() {
-			envStr := scanner.Text()
-
-			if envStr == "" {
-				continue
-			}
-
-			if !strings.Contains(envStr, "=") {
-				continue
-			}
-
-			envStrSplit := strings.Split(envStr, "=")
-			envKey := envStrSplit[0]
-			envValue := strings.Join(envStrSplit[1:], "=")
+// reservedRunnerArguments are set by the step or TestLab based on the sharding and test target inputs,
+// these can not be passed as runner arguments.
+var reservedRunnerArguments = map[string]string{
+	"class":            "inst_test_targets",
+	"notClass":         "inst_test_targets",
+	"package":          "inst_test_targets",
+	"notPackage":       "inst_test_targets",
+	"size":             "inst_test_targets",
+	"annotation":       "inst_test_targets",
+	"notAnnotation":    "inst_test_targets",
+	"testFile":         "inst_test_targets",
+	"notTestFile":      "inst_test_targets",
+	"numShards":        "inst_num_uniform_shards",
+	"shardIndex":       "inst_num_uniform_shards",
+	"clearPackageData": "inst_clear_package_data",
+}
 
-			envs = append(envs, &EnvironmentVariable{Key: envKey, Value: envValue})
+// parseRunnerArguments parses the instrumentation runner arguments, one key=value pair per line.
+func parseRunnerArguments(value string) ([]*EnvironmentVariable, error) {
+	arguments := []*EnvironmentVariable{}
+	keys := []string{}
+	for _, line := range parseLines(value) {
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid runner argument (%s), the format is: key=value", line)
 		}
-
-		testModel.TestSpecification = &TestSpecification{
-			TestTimeout: fmt.Sprintf("%ss", configs.TestTimeout),
-			TestSetup: &TestSetup{
-				EnvironmentVariables: envs,
-				DirectoriesToPull:    directoriesToPull,
-			},
+		key := strings.TrimSpace(split[0])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid runner argument key (%s)", split[0])
 		}
+		if input, ok := reservedRunnerArguments[key]; ok {
+			return nil, fmt.Errorf("runner argument (%s) is reserved, use the %s input instead", key, input)
+		}
+		if sliceutil.IsStringInSlice(key, keys) {
+			return nil, fmt.Errorf("runner argument (%s) specified more than once", key)
+		}
+		keys = append(keys, key)
+		arguments = append(arguments, &EnvironmentVariable{Key: key, Value: split[1]})
+	}
+	return arguments, nil
+}
 
-		switch configs.TestType {
-		case "instrumentation":
-			testModel.TestSpecification.AndroidInstrumentationTest = &AndroidInstrumentationTest{}
-			if configs.AppPackageID != "" {
-				testModel.TestSpecification.AndroidInstrumentationTest.AppPackageID = configs.AppPackageID
-			}
-			if configs.InstTestPackageID != "" {
-				testModel.TestSpecification.AndroidInstrumentationTest.TestPackageID = configs.InstTestPackageID
-			}
-			if configs.InstTestRunnerClass != "" {
-				testModel.TestSpecification.AndroidInstrumentationTest.TestRunnerClass = configs.InstTestRunnerClass
-			}
-			if configs.InstTestTargets != "" {
-				targets := strings.Split(strings.TrimSpace(configs.InstTestTargets), ",")
-				testModel.TestSpecification.AndroidInstrumentationTest.TestTargets = targets
-			}
-		case "robo":
-			testModel.TestSpecification.AndroidRoboTest = &AndroidRoboTest{}
-			if configs.AppPackageID != "" {
-				testModel.TestSpecification.AndroidRoboTest.AppPackageID = configs.AppPackageID
-			}
-			if configs.RoboInitialActivity != "" {
-				testModel.TestSpecification.AndroidRoboTest.AppInitialActivity = configs.RoboInitialActivity
-			}
-			if configs.RoboMaxDepth != "" {
-				maxDepth, err := strconv.Atoi(configs.RoboMaxDepth)
-				if err != nil {
-					failf("Failed to parse string(%s) to integer, error: %s", configs.RoboMaxDepth, err)
-				}
-				testModel.TestSpecification.AndroidRoboTest.MaxDepth = int64(maxDepth)
-			}
-			if configs.RoboMaxSteps != "" {
-				maxSteps, err := strconv.Atoi(configs.RoboMaxSteps)
-				if err != nil {
-					failf("Failed to parse string(%s) to integer, error: %s", configs.RoboMaxSteps, err)
-				}
-				testModel.TestSpecification.AndroidRoboTest.MaxSteps = int64(maxSteps)
-			}
-			if configs.RoboDirectives != "" {
-				roboDirectives := []*RoboDirective{}
-				scanner := bufio.NewScanner(strings.NewReader(configs.RoboDirectives))
-				for scanner.Scan() {
-					directive := scanner.Text()
-					directive = strings.TrimSpace(directive)
-					if directive == "" {
-						continue
-					}
-
-					directiveParams := strings.Split(directive, ",")
-					if len(directiveParams) != 3 {
-						failf("Invalid directive configuration: %s", directive)
-					}
-					roboDirectives = append(roboDirectives, &RoboDirective{ResourceName: directiveParams[0], InputText: directiveParams[1], ActionType: directiveParams[2]})
-				}
-				testModel.TestSpecification.AndroidRoboTest.RoboDirectives = roboDirectives
-			}
-		case "gameloop":
-			testModel.TestSpecification.AndroidTestLoop = &AndroidTestLoop{}
-			if configs.AppPackageID != "" {
-				testModel.TestSpecification.AndroidTestLoop.AppPackageID = configs.AppPackageID
-			}
-			if configs.LoopScenarios != "" {
-				loopScenarios := []int64{}
-				for _, scenarioStr := range strings.Split(strings.TrimSpace(configs.LoopScenarios), ",") {
-					scenario, err := strconv.Atoi(scenarioStr)
-					if err != nil {
-						failf("Failed to parse string(%s) to integer, error: %s", scenarioStr, err)
-					}
-					loopScenarios = append(loopScenarios, int64(scenario))
-				}
-				testModel.TestSpecification.AndroidTestLoop.Scenarios = loopScenarios
-			}
-			if configs.LoopScenarioLabels != "" {
-				scenarioLabels := strings.Split(strings.TrimSpace(configs.LoopScenarioLabels), ",")
-				testModel.TestSpecification.AndroidTestLoop.ScenarioLabels = scenarioLabels
-			}
+// parseLines returns the trimmed, non-empty lines of the given input.
+func parseLines(value string) []string {
+	lines := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(value))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
+		lines = append(lines, line)
+	}
+	return lines
+}
 
-		jsonByte, err := json.Marshal(testModel)
-		if err != nil {
-			failf("Failed to marshal test model, error: %s", err)
+// testTypes returns the "," separated test types to run.
+func (configs ConfigsModel) testTypes() []string {
+	testTypes := []string{}
+	for _, testType := range strings.Split(configs.TestType, ",") {
+		if testType = strings.TrimSpace(testType); testType != "" {
+			testTypes = append(testTypes, testType)
 		}
+	}
+	return testTypes
+}
 
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonByte))
-		if err != nil {
-			failf("Failed to create http request, error: %s", err)
+func (configs ConfigsModel) hasTestType(testType string) bool {
+	return sliceutil.IsStringInSlice(testType, configs.testTypes())
+}
+
+// downloadTestResultsMode returns the download test results mode, mapping the legacy true and false values.
+func (configs ConfigsModel) downloadTestResultsMode() string {
+	switch configs.DownloadTestResults {
+	case "true":
+		return downloadTestResultsAlways
+	case "false", "":
+		return downloadTestResultsNever
+	}
+	return configs.DownloadTestResults
+}
+
+// testApkPaths returns the test APKs, one path or glob pattern per line.
+func (configs ConfigsModel) testApkPaths() ([]string, error) {
+	testApkPaths := []string{}
+	for _, pattern := range parseLines(configs.TestApkPath) {
+		if !strings.ContainsAny(pattern, "*?[") {
+			testApkPaths = append(testApkPaths, pattern)
+			continue
 		}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		matches, err := filepath.Glob(pattern)
 		if err != nil {
-			failf("Failed to get http response, error: %s", err)
+			return nil, fmt.Errorf("invalid glob pattern (%s), error: %s", pattern, err)
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			failf("Failed to get http response, status code: %d", resp.StatusCode)
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no test APK found matching: %s", pattern)
 		}
+		testApkPaths = append(testApkPaths, matches...)
+	}
+	return testApkPaths, nil
+}
 
-		log.Donef("=> Test started")
+// filesToPush returns the files to push to the device, including the game loop test's OBB files.
+func (configs ConfigsModel) filesToPush() ([]FileToPush, error) {
+	files, err := parseFilesToPush(configs.FilesToPush)
+	if err != nil {
+		return nil, err
 	}
+	if configs.hasTestType("gameloop") {
+		for _, obbPath := range parseLines(configs.LoopObbFiles) {
+			files = append(files, FileToPush{LocalPath: obbPath})
+		}
+	}
+	return files, nil
+}
 
-	fmt.Println()
-	log.Infof("Waiting for test results")
-	{
-		finished := false
-		printedLogs := []string{}
-		for !finished {
-			url := configs.APIBaseURL + "/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken
-
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				failf("Failed to create http request, error: %s", err)
-			}
+// loopScenarioLabels are the predefined game loop labels of TestLab.
+var loopScenarioLabels = []string{
+	"com.google.test.loops.player_experience",
+	"com.google.test.loops.gpu_compatibility",
+	"com.google.test.loops.compatibility",
+	"com.google.test.loops.performance",
+}
 
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				failf("Failed to get http response, error: %s", err)
-			}
+// maxLoopScenarios is the maximum number of game loop scenarios, every scenario is reported as a separate test.
+const maxLoopScenarios = 1000
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				failf("Failed to read response body, error: %s", err)
-			}
+// parseLoopScenarios parses the "," separated scenario numbers and ranges, e.g. 1-5,8
+func parseLoopScenarios(value string) ([]int64, error) {
+	scenarios := []int64{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
 
-			responseModel := &ListStepsResponse{}
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return nil, fmt.Errorf("invalid scenario range: %s", item)
+		}
 
-			err = json.Unmarshal(body, responseModel)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse string(%s) to integer, error: %s", bounds[0], err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
 			if err != nil {
-				failf("Failed to unmarshal response body, error: %s, body: %s", err, string(body))
+				return nil, fmt.Errorf("failed to parse string(%s) to integer, error: %s", bounds[1], err)
 			}
+		}
+		if first < 1 || last < first {
+			return nil, fmt.Errorf("invalid scenario range: %s, scenarios are positive integers in ascending order", item)
+		}
+		if len(scenarios)+last-first+1 > maxLoopScenarios {
+			return nil, fmt.Errorf("too many scenarios, at most %d scenarios are allowed", maxLoopScenarios)
+		}
 
-			finished = true
-			testsRunning := 0
-			for _, step := range responseModel.Steps {
-				if step.State != "complete" {
-					finished = false
-					testsRunning++
-				}
-			}
+		for scenario := first; scenario <= last; scenario++ {
+			scenarios = append(scenarios, int64(scenario))
+		}
+	}
+	return scenarios, nil
+}
 
-			msg := ""
-			if len(responseModel.Steps) == 0 {
-				finished = false
-				msg = fmt.Sprintf("- Validating")
-			} else {
-				msg = fmt.Sprintf("- (%d/%d) running", testsRunning, len(responseModel.Steps))
-			}
+// parseLoopScenarioLabels parses the "," separated labels, which have to be TestLab's predefined labels.
+func parseLoopScenarioLabels(value string) ([]string, error) {
+	labels := []string{}
+	for _, label := range strings.Split(value, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		if !sliceutil.IsStringInSlice(label, loopScenarioLabels) {
+			return nil, fmt.Errorf("invalid scenario label: %s, available: %v", label, loopScenarioLabels)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
 
-			if !sliceutil.IsStringInSlice(msg, printedLogs) {
-				log.Printf(msg)
-				printedLogs = append(printedLogs, msg)
-			}
+// parseFilesToPush parses one "local_path,device_path" pair per line.
+// OBB files are given without device path, TestLab pushes them to the app's OBB directory.
+func parseFilesToPush(value string) ([]FileToPush, error) {
+	files := []FileToPush{}
+	for _, line := range parseLines(value) {
+		params := strings.Split(line, ",")
+		if len(params) > 2 {
+			return nil, fmt.Errorf("invalid file configuration: %s", line)
+		}
 
-			if finished {
-				log.Donef("=> Test finished")
-				fmt.Println()
-
-				log.Infof("Test results:")
-				w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-				fmt.Fprintln(w, "Model\tAPI Level\tLocale\tOrientation\tOutcome\t")
-
-				for _, step := range responseModel.Steps {
-					dimensions := map[string]string{}
-					for _, dimension := range step.DimensionValue {
-						dimensions[dimension.Key] = dimension.Value
-					}
-
-					outcome := step.Outcome.Summary
-
-					switch outcome {
-					case "success":
-						outcome = colorstring.Green(outcome)
-					case "failure":
-						successful = false
-						if step.Outcome.FailureDetail != nil {
-							if step.Outcome.FailureDetail.Crashed {
-								outcome += "(Crashed)"
-							}
-							if step.Outcome.FailureDetail.NotInstalled {
-								outcome += "(NotInstalled)"
-							}
-							if step.Outcome.FailureDetail.OtherNativeCrash {
-								outcome += "(OtherNativeCrash)"
-							}
-							if step.Outcome.FailureDetail.TimedOut {
-								outcome += "(TimedOut)"
-							}
-							if step.Outcome.FailureDetail.UnableToCrawl {
-								outcome += "(UnableToCrawl)"
-							}
-						}
-						outcome = colorstring.Red(outcome)
-					case "inconclusive":
-						successful = false
-						if step.Outcome.InconclusiveDetail != nil {
-							if step.Outcome.InconclusiveDetail.AbortedByUser {
-								outcome += "(AbortedByUser)"
-							}
-							if step.Outcome.InconclusiveDetail.InfrastructureFailure {
-								outcome += "(InfrastructureFailure)"
-							}
-						}
-						outcome = colorstring.Yellow(outcome)
-					case "skipped":
-						successful = false
-						if step.Outcome.SkippedDetail != nil {
-							if step.Outcome.SkippedDetail.IncompatibleAppVersion {
-								outcome += "(IncompatibleAppVersion)"
-							}
-							if step.Outcome.SkippedDetail.IncompatibleArchitecture {
-								outcome += "(IncompatibleArchitecture)"
-							}
-							if step.Outcome.SkippedDetail.IncompatibleDevice {
-								outcome += "(IncompatibleDevice)"
-							}
-						}
-						outcome = colorstring.Blue(outcome)
-					}
-
-					fmt.Fprintln(w, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t", dimensions["Model"], dimensions["Version"], dimensions["Locale"], dimensions["Orientation"], outcome))
-				}
-				w.Flush()
-			}
-			if !finished {
-				time.Sleep(5 * time.Second)
-			}
+		file := FileToPush{LocalPath: strings.TrimSpace(params[0])}
+		if len(params) == 2 {
+			file.DevicePath = strings.TrimSpace(params[1])
 		}
+
+		if file.DevicePath == "" && filepath.Ext(file.LocalPath) != ".obb" {
+			return nil, fmt.Errorf("device path not specified for non OBB file: %s", line)
+		}
+		files = append(files, file)
 	}
+	return files, nil
+}
 
-	if configs.DownloadTestResults == "true" {
-		fmt.Println()
-		log.Infof("Downloading test assets")
-		{
-			url := configs.APIBaseURL + "/assets/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken
+var allowedDevicePathPrefixes = []string{"/sdcard/", "/data/local/tmp/", "${EXTERNAL_STORAGE}/", "${ANDROID_DATA}/local/tmp/"}
 
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				failf("Failed to create http request, error: %s", err)
-			}
+func validateDevicePath(devicePath string) error {
+	for _, component := range strings.Split(devicePath, "/") {
+		if component == ".." {
+			return fmt.Errorf("device path (%s) must not contain \"..\"", devicePath)
+		}
+	}
+	for _, prefix := range allowedDevicePathPrefixes {
+		if strings.HasPrefix(devicePath, prefix) && len(devicePath) > len(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("device path (%s) has to be a file under one of: %s", devicePath, strings.Join(allowedDevicePathPrefixes, ", "))
+}
 
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				failf("Failed to get http response, error: %s", err)
-			}
+// validateObbFileName checks the required <main|patch>.<version code>.<package name>.obb format.
+func validateObbFileName(fileName string) error {
+	parts := strings.SplitN(strings.TrimSuffix(fileName, ".obb"), ".", 3)
+	if len(parts) != 3 || (parts[0] != "main" && parts[0] != "patch") {
+		return fmt.Errorf("OBB file name (%s) has to be in the format of: <main|patch>.<version code>.<package name>.obb", fileName)
+	}
+	if _, err := strconv.Atoi(parts[1]); err != nil {
+		return fmt.Errorf("OBB file name (%s) has invalid version code: %s", fileName, parts[1])
+	}
+	return nil
+}
 
-			if resp.StatusCode != http.StatusOK {
-				failf("Failed to get http response, status code: %d", resp.StatusCode)
-			}
+func main() {
+	configs := createConfigsModelFromEnvs()
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				failf("Failed to read response body, error: %s", err)
-			}
+	fmt.Println()
+	configs.print()
 
-			responseModel := map[string]string{}
+	run := newTestRun(configs)
+	if err := run.finalize(run.execute()); err != nil {
+		fmt.Println()
+		exitWithError(err)
+	}
+}
 
-			err = json.Unmarshal(body, &responseModel)
-			if err != nil {
-				failf("Failed to unmarshal response body, error: %s", err)
-			}
+// getTestAssetURLs returns the download URLs of the matrix's test assets by file name.
+func getTestAssetURLs(configs ConfigsModel, matrix *TestMatrixRun) (map[string]string, error) {
+	req, err := http.NewRequest("GET", matrix.assetsURL(configs), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create http request, error: %s", err)
+	}
 
-			tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_test_assets")
-			if err != nil {
-				failf("Failed to create temp dir, error: %s", err)
-			}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get http response, error: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Failed to close response body: %s", err)
+		}
+	}()
 
-			for fileName, fileURL := range responseModel {
-				err := downloadFile(fileURL, filepath.Join(tempDir, fileName))
-				if err != nil {
-					failf("Failed to download file, error: %s", err)
-				}
-			}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get http response, status code: %d", resp.StatusCode)
+	}
 
-			log.Donef("=> Assets downloaded")
-			if err := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_RESULTS_PATH", tempDir); err != nil {
-				log.Warnf("Failed to export environment (FIREBASE_TEST_RESULTS_PATH), error: %s", err)
-			} else {
-				log.Printf("The downloaded test assets path (%s) is exported to the FIREBASE_TEST_RESULTS_PATH environment variable.", tempDir)
-			}
-		}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body, error: %s", err)
 	}
 
-	if !successful {
-		os.Exit(1)
+	responseModel := map[string]string{}
+	if err := json.Unmarshal(body, &responseModel); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal response body, error: %s", err)
 	}
+	return responseModel, nil
 }
 
-func downloadFile(url string, localPath string) error {
+// downloadFile downloads the url to the local path, the partially downloaded file is removed on failure.
+func downloadFile(url string, localPath string) (err error) {
 	out, err := os.Create(localPath)
 	if err != nil {
 		return fmt.Errorf("Failed to open the local cache file for write: %s", err)
 	}
 	defer func() {
-		if err := out.Close(); err != nil {
-			log.Printf("Failed to close Archive download file (%s): %s", localPath, err)
+		if closeErr := out.Close(); closeErr != nil {
+			log.Printf("Failed to close Archive download file (%s): %s", localPath, closeErr)
+		}
+		if err != nil {
+			if removeErr := os.Remove(localPath); removeErr != nil {
+				log.Printf("Failed to remove partially downloaded file (%s): %s", localPath, removeErr)
+			}
 		}
 	}()
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLoopScenarios(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []int64
+		wantErr bool
+	}{
+		{name: "numbers and ranges", value: "1-3, 5,8-8", want: []int64{1, 2, 3, 5, 8}},
+		{name: "empty items", value: "2,,", want: []int64{2}},
+		{name: "empty", value: "", want: []int64{}},
+		{name: "the maximum number of scenarios", value: "1-1000", want: func() []int64 {
+			scenarios := []int64{}
+			for i := int64(1); i <= 1000; i++ {
+				scenarios = append(scenarios, i)
+			}
+			return scenarios
+		}()},
+		{name: "too many scenarios", value: "1-1000,1001", wantErr: true},
+		{name: "huge range", value: "1-2000000000", wantErr: true},
+		{name: "descending range", value: "5-1", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "negative", value: "-1", wantErr: true},
+		{name: "more bounds", value: "1-2-3", wantErr: true},
+		{name: "not a number", value: "first", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLoopScenarios(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLoopScenarios() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLoopScenarios() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRoboDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []*RoboDirective
+		wantErr bool
+	}{
+		{
+			name:  "directives",
+			value: "username,john,ENTER_TEXT\nlogin_button,,SINGLE_CLICK\nad_banner,,IGNORE",
+			want: []*RoboDirective{
+				{ResourceName: "username", InputText: "john", ActionType: "ENTER_TEXT"},
+				{ResourceName: "login_button", ActionType: "SINGLE_CLICK"},
+				{ResourceName: "ad_banner", ActionType: "IGNORE"},
+			},
+		},
+		{
+			name:  "quoted input text",
+			value: `username,"Doe, John",ENTER_TEXT`,
+			want:  []*RoboDirective{{ResourceName: "username", InputText: "Doe, John", ActionType: "ENTER_TEXT"}},
+		},
+		{
+			name:  "quoted input text with quotes",
+			value: `greeting, "say ""hi""", ENTER_TEXT`,
+			want:  []*RoboDirective{{ResourceName: "greeting", InputText: `say "hi"`, ActionType: "ENTER_TEXT"}},
+		},
+		{
+			name:  "click is sent as single click",
+			value: "login_button,,CLICK",
+			want:  []*RoboDirective{{ResourceName: "login_button", ActionType: "SINGLE_CLICK"}},
+		},
+		{name: "unquoted comma", value: "username,Doe, John,ENTER_TEXT", wantErr: true},
+		{name: "missing action type", value: "username,john", wantErr: true},
+		{name: "missing resource name", value: ",john,ENTER_TEXT", wantErr: true},
+		{name: "invalid action type", value: "login_button,,TAP", wantErr: true},
+		{name: "input text of a click", value: "login_button,text,SINGLE_CLICK", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRoboDirectives(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRoboDirectives() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRoboDirectives() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	markdownSummaryFileName = "firebase_test_summary.md"
+	// maxMarkdownSummarySize keeps the summary below the 65536 characters limit of the GitHub comments.
+	maxMarkdownSummarySize = 60000
+	// maxMarkdownDevices and maxMarkdownFailingTests are the initial limits of the listed rows,
+	// these are halved until the summary fits into maxMarkdownSummarySize.
+	maxMarkdownDevices      = 50
+	maxMarkdownFailingTests = 20
+)
+
+var outcomeBadges = map[string]string{
+	"success":      "✅",
+	"flaky":        "⚠️",
+	"skipped":      "⏭️",
+	"inconclusive": "❔",
+	"failure":      "❌",
+}
+
+// markdownFailingTest is a failed test case, aggregated over the devices.
+type markdownFailingTest struct {
+	Name       string
+	Devices    int
+	FirstError string
+}
+
+// createMarkdownSummary returns the summary with the non-successful devices listed first.
+// If the summary does not fit into maxSize, less devices and failing tests are listed.
+func createMarkdownSummary(summary *ResultsSummary, buildURL string, maxSize int) string {
+	maxDevices := maxMarkdownDevices
+	maxFailingTests := maxMarkdownFailingTests
+	for {
+		markdown := renderMarkdownSummary(summary, buildURL, maxDevices, maxFailingTests)
+		if len(markdown) <= maxSize {
+			return markdown
+		}
+		if maxDevices == 0 && maxFailingTests == 0 {
+			const truncated = "\n\n_Summary truncated._\n"
+			return truncateUTF8(markdown, maxSize-len(truncated)) + truncated
+		}
+		maxDevices /= 2
+		maxFailingTests /= 2
+	}
+}
+
+func renderMarkdownSummary(summary *ResultsSummary, buildURL string, maxDevices, maxFailingTests int) string {
+	var md bytes.Buffer
+
+	verdict := "passed"
+	if !summary.Successful {
+		verdict = "failed"
+	}
+	if summary.Outcome == "" {
+		fmt.Fprintf(&md, "### %s Firebase TestLab: no results (%s)\n\n", outcomeBadges["failure"], verdict)
+	} else {
+		fmt.Fprintf(&md, "### %s Firebase TestLab: %s (%s)\n\n", outcomeBadges[summary.Outcome], summary.Outcome, verdict)
+	}
+
+	counts := []string{}
+	for _, outcome := range summaryOutcomes {
+		if summary.Counts[outcome] > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d %s", outcomeBadges[outcome], summary.Counts[outcome], outcome))
+		}
+	}
+	fmt.Fprintf(&md, "%d device(s): %s\n\n", len(summary.Devices), strings.Join(counts, " · "))
+
+	devices := append([]*DeviceSummary{}, summary.Devices...)
+	sort.SliceStable(devices, func(i, j int) bool {
+		return outcomeSeverity[devices[i].Outcome] > outcomeSeverity[devices[j].Outcome]
+	})
+	if len(devices) > 0 && maxDevices > 0 {
+		md.WriteString("| Test | Device | Outcome | Tests |\n|---|---|---|---|\n")
+		for i, device := range devices {
+			if i == maxDevices {
+				break
+			}
+			outcome := outcomeBadges[device.Outcome] + " " + device.Outcome
+			if len(device.Details) > 0 {
+				outcome += " (" + strings.Join(device.Details, ", ") + ")"
+			}
+			if len(device.Attempts) > 1 {
+				outcome += " after " + strings.Join(device.Attempts[:len(device.Attempts)-1], ", ")
+			}
+			tests := "-"
+			if device.TestCount != nil {
+				tests = fmt.Sprintf("%d", *device.TestCount)
+			}
+			test := device.TestType
+			if device.Matrix != "" && device.Matrix != device.TestType {
+				test += " " + device.Matrix
+			}
+			name := deviceName(&DeviceResult{Dimensions: device.Dimensions})
+			if device.Optional {
+				name += " (optional)"
+			}
+			fmt.Fprintf(&md, "| %s | %s | %s | %s |\n", escapeMarkdownCell(test), escapeMarkdownCell(name), escapeMarkdownCell(outcome), tests)
+		}
+		md.WriteString("\n")
+	}
+	if hidden := len(devices) - maxDevices; hidden > 0 {
+		fmt.Fprintf(&md, "_... and %d more device(s)._\n\n", hidden)
+	}
+
+	failingTests := aggregateFailingTests(summary.Devices)
+	if len(failingTests) > 0 {
+		md.WriteString("**Failing tests**\n\n")
+		for i, test := range failingTests {
+			if i == maxFailingTests {
+				fmt.Fprintf(&md, "- _... and %d more failing test(s)._\n", len(failingTests)-maxFailingTests)
+				break
+			}
+			fmt.Fprintf(&md, "- %s on %d device(s)", markdownCode(test.Name), test.Devices)
+			if test.FirstError != "" {
+				fmt.Fprintf(&md, ": %s", markdownCode(test.FirstError))
+			}
+			md.WriteString("\n")
+		}
+		md.WriteString("\n")
+	}
+
+	flaky := []string{}
+	for _, device := range summary.Devices {
+		if device.Outcome == "flaky" {
+			flaky = append(flaky, deviceName(&DeviceResult{Dimensions: device.Dimensions}))
+		}
+		for _, testCase := range device.TestCases {
+			if testCase.Status == "flaky" {
+				flaky = append(flaky, markdownCode(testCase.ClassName+"#"+testCase.Name))
+			}
+		}
+	}
+	if len(flaky) > 0 {
+		fmt.Fprintf(&md, "**Flaky**: %s\n\n", strings.Join(uniqueStrings(flaky), ", "))
+	}
+
+	if buildURL != "" {
+		fmt.Fprintf(&md, "[Build details and test reports](%s)\n", buildURL)
+	}
+	return md.String()
+}
+
+// aggregateFailingTests returns the failed test cases, the ones failing on the most devices first.
+func aggregateFailingTests(devices []*DeviceSummary) []*markdownFailingTest {
+	tests := []*markdownFailingTest{}
+	testByName := map[string]*markdownFailingTest{}
+	for _, device := range devices {
+		for _, testCase := range device.TestCases {
+			if testCase.Status != "failed" && testCase.Status != "error" {
+				continue
+			}
+			name := testCase.ClassName + "#" + testCase.Name
+			test, ok := testByName[name]
+			if !ok {
+				test = &markdownFailingTest{Name: name, FirstError: firstLine(testCase.StackTrace)}
+				testByName[name] = test
+				tests = append(tests, test)
+			}
+			test.Devices++
+		}
+	}
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].Devices > tests[j].Devices
+	})
+	return tests
+}
+
+func escapeMarkdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "`", "\\`").Replace(text)
+}
+
+// markdownCode returns the text as a code span, backslashes do not escape in code spans, so the backticks are replaced.
+func markdownCode(text string) string {
+	return "`" + strings.Replace(text, "`", "'", -1) + "`"
+}
+
+func uniqueStrings(values []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// truncateUTF8 cuts the text to at most size bytes, without splitting a multi-byte character.
+func truncateUTF8(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && (text[size]&0xC0) == 0x80 {
+		size--
+	}
+	return text[:size]
+}
+
+// writeMarkdownSummary writes the Markdown summary into a temp dir and returns its path.
+func writeMarkdownSummary(markdown string) (string, error) {
+	tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_markdown_summary")
+	if err != nil {
+		return "", err
+	}
+
+	summaryPath := filepath.Join(tempDir, markdownSummaryFileName)
+	if err := ioutil.WriteFile(summaryPath, []byte(markdown), 0644); err != nil {
+		return "", err
+	}
+	return summaryPath, nil
+}
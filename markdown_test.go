@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCreateMarkdownSummary(t *testing.T) {
+	summary := &ResultsSummary{Outcome: "failure", Counts: map[string]int{"failure": 100}}
+	for i := 0; i < 100; i++ {
+		summary.Devices = append(summary.Devices, &DeviceSummary{
+			TestType:   "instrumentation",
+			Dimensions: map[string]string{"Model": fmt.Sprintf("Pixel%d", i), "Version": "28", "Locale": "en", "Orientation": "portrait"},
+			Outcome:    "failure",
+			Attempts:   []string{"failure"},
+			TestCases: []*TestCaseSummary{{
+				Name:       fmt.Sprintf("test%d", i),
+				ClassName:  "com.example.LoginTest",
+				Status:     "failed",
+				StackTrace: "java.lang.AssertionError: ❌ expected",
+			}},
+		})
+	}
+	full := createMarkdownSummary(summary, "https://app.bitrise.io/build/slug", maxMarkdownSummarySize)
+
+	tests := []struct {
+		name          string
+		maxSize       int
+		wantTruncated bool
+		wantContains  []string
+	}{
+		{
+			name:         "fits",
+			maxSize:      maxMarkdownSummarySize,
+			wantContains: []string{"_... and 50 more device(s)._", "_... and 80 more failing test(s)._", "(https://app.bitrise.io/build/slug)"},
+		},
+		{
+			name:         "less devices and failing tests",
+			maxSize:      len(full) / 2,
+			wantContains: []string{"more device(s)._", "more failing test(s)._"},
+		},
+		{
+			name:          "truncated",
+			maxSize:       100,
+			wantTruncated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markdown := createMarkdownSummary(summary, "https://app.bitrise.io/build/slug", tt.maxSize)
+			if len(markdown) > tt.maxSize {
+				t.Errorf("createMarkdownSummary() size = %d, want at most %d", len(markdown), tt.maxSize)
+			}
+			if !utf8.ValidString(markdown) {
+				t.Errorf("createMarkdownSummary() is not valid UTF-8")
+			}
+			if got := strings.HasSuffix(markdown, "_Summary truncated._\n"); got != tt.wantTruncated {
+				t.Errorf("createMarkdownSummary() truncated = %v, want %v", got, tt.wantTruncated)
+			}
+			for _, text := range tt.wantContains {
+				if !strings.Contains(markdown, text) {
+					t.Errorf("createMarkdownSummary() does not contain %q", text)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		text string
+		size int
+		want string
+	}{
+		{text: "abc", size: 5, want: "abc"},
+		{text: "abc", size: 2, want: "ab"},
+		{text: "a✅b", size: 3, want: "a"},
+		{text: "a✅b", size: 4, want: "a✅"},
+		{text: "✅", size: 0, want: ""},
+	}
+	for _, tt := range tests {
+		if got := truncateUTF8(tt.text, tt.size); got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.text, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCreateMarkdownSummaryEscaping(t *testing.T) {
+	summary := &ResultsSummary{Outcome: "failure", Counts: map[string]int{"failure": 1}}
+	summary.Devices = append(summary.Devices, &DeviceSummary{
+		TestType:   "instrumentation",
+		Dimensions: map[string]string{"Model": "Pixel2", "Version": "28", "Locale": "en", "Orientation": "portrait"},
+		Outcome:    "failure",
+		Attempts:   []string{"failure"},
+		TestCases: []*TestCaseSummary{
+			{Name: "test`quoted`|piped", ClassName: "com.example.LoginTest", Status: "failed", StackTrace: "java.lang.AssertionError: expected `a`"},
+			{Name: "test`flaky`", ClassName: "com.example.LoginTest", Status: "flaky"},
+		},
+	})
+
+	markdown := createMarkdownSummary(summary, "", maxMarkdownSummarySize)
+	for _, text := range []string{
+		"- `com.example.LoginTest#test'quoted'|piped` on 1 device(s): `java.lang.AssertionError: expected 'a'`",
+		"**Flaky**: `com.example.LoginTest#test'flaky'`",
+	} {
+		if !strings.Contains(markdown, text) {
+			t.Errorf("createMarkdownSummary() does not contain %q\n%s", text, markdown)
+		}
+	}
+}
+
+func TestEscapeMarkdownCell(t *testing.T) {
+	if got, want := escapeMarkdownCell("a|b`c`"), "a\\|b\\`c\\`"; got != want {
+		t.Errorf("escapeMarkdownCell() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/sliceutil"
+)
+
+// TestMatrixRun is a test matrix started by the step.
+type TestMatrixRun struct {
+	// ID identifies the matrix in the API requests, it is empty if the step starts a single matrix.
+	ID        string
+	Name      string
+	TestType  string
+	Model     *TestMatrix
+	ShardPlan *ShardPlan
+	Steps     []*Step
+	// Attempt is 0 for the first run, and the rerun's number for the reruns of the failed devices.
+	Attempt int
+	// Origin is the first run's matrix of a rerun.
+	Origin *TestMatrixRun
+	// FailedTestsOnly is set if the rerun runs only the failed test cases of the devices.
+	FailedTestsOnly bool
+}
+
+// origin returns the first run's matrix.
+func (matrix *TestMatrixRun) origin() *TestMatrixRun {
+	if matrix.Origin != nil {
+		return matrix.Origin
+	}
+	return matrix
+}
+
+// rerunID returns the ID of the matrix's rerun of the given attempt.
+func (matrix *TestMatrixRun) rerunID(attempt int) string {
+	id := matrix.ID
+	if id == "" {
+		id = matrix.TestType
+	}
+	return fmt.Sprintf("%s-rerun-%d", id, attempt)
+}
+
+// finished returns true if every step of the matrix is complete.
+func (matrix TestMatrixRun) finished() bool {
+	if len(matrix.Steps) == 0 {
+		return false
+	}
+	for _, step := range matrix.Steps {
+		if step.State != "complete" {
+			return false
+		}
+	}
+	return true
+}
+
+func (matrix TestMatrixRun) url(configs ConfigsModel) string {
+	return matrix.withID(configs.APIBaseURL + "/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken)
+}
+
+// assetsURL is the url of the matrix's test assets.
+func (matrix TestMatrixRun) assetsURL(configs ConfigsModel) string {
+	return matrix.withID(configs.APIBaseURL + "/assets/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken)
+}
+
+// withID adds the matrix ID to the url, the backend's default matrix has no ID.
+func (matrix TestMatrixRun) withID(matrixURL string) string {
+	if matrix.ID != "" {
+		matrixURL += "?matrix_id=" + url.QueryEscape(matrix.ID)
+	}
+	return matrixURL
+}
+
+// startTestMatrix submits the matrix's test model.
+func startTestMatrix(configs ConfigsModel, matrix *TestMatrixRun) error {
+	jsonByte, err := json.Marshal(matrix.Model)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal test model, error: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", matrix.url(configs), bytes.NewBuffer(jsonByte))
+	if err != nil {
+		return fmt.Errorf("Failed to create http request, error: %s", err)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to get http response, error: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to get http response, status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// startTestMatrices starts the matrices concurrently.
+func startTestMatrices(configs ConfigsModel, matrices []*TestMatrixRun) error {
+	return forEachMatrix(matrices, func(matrix *TestMatrixRun) error {
+		if err := startTestMatrix(configs, matrix); err != nil {
+			return fmt.Errorf("(%s) %s", matrix.Name, err)
+		}
+		return nil
+	})
+}
+
+// updateTestMatricesSteps fetches the steps of the matrices concurrently.
+func updateTestMatricesSteps(configs ConfigsModel, matrices []*TestMatrixRun) error {
+	return forEachMatrix(matrices, func(matrix *TestMatrixRun) error {
+		if err := updateTestMatrixSteps(configs, matrix); err != nil {
+			return fmt.Errorf("(%s) %s", matrix.Name, err)
+		}
+		return nil
+	})
+}
+
+const (
+	// defaultTestTimeoutSeconds is TestLab's default test timeout, used if the test timeout input is not a number.
+	defaultTestTimeoutSeconds = 900
+	// pollTimeoutMargin is added to the test timeout to wait for the devices, the validation and the results.
+	pollTimeoutMargin = 30 * time.Minute
+)
+
+// pollTimeout returns how long the step waits for a matrix: the test timeout of every flaky test attempt,
+// plus a margin.
+func (configs ConfigsModel) pollTimeout() time.Duration {
+	testTimeout, err := strconv.Atoi(configs.TestTimeout)
+	if err != nil || testTimeout <= 0 {
+		testTimeout = defaultTestTimeoutSeconds
+	}
+	flakyTestAttempts, err := strconv.Atoi(configs.FlakyTestAttempts)
+	if err != nil || flakyTestAttempts < 0 {
+		flakyTestAttempts = 0
+	}
+	return time.Duration(testTimeout*(flakyTestAttempts+1))*time.Second + pollTimeoutMargin
+}
+
+// waitForTestMatrices polls the matrices' steps until every matrix finishes,
+// it returns a timeout error if the matrices do not finish within the poll timeout.
+func waitForTestMatrices(configs ConfigsModel, matrices []*TestMatrixRun) error {
+	timeout := configs.pollTimeout()
+	deadline := time.Now().Add(timeout)
+	printedLogs := []string{}
+	for {
+		if err := updateTestMatricesSteps(configs, matrices); err != nil {
+			return err
+		}
+
+		finished := true
+		validating := false
+		testsRunning := 0
+		testsTotal := 0
+		for _, matrix := range matrices {
+			if !matrix.finished() {
+				finished = false
+			}
+			if len(matrix.Steps) == 0 {
+				validating = true
+			}
+			for _, step := range matrix.Steps {
+				if step.State != "complete" {
+					testsRunning++
+				}
+			}
+			testsTotal += len(matrix.Steps)
+		}
+
+		msg := ""
+		if validating {
+			msg = fmt.Sprintf("- Validating")
+		} else {
+			msg = fmt.Sprintf("- (%d/%d) running", testsRunning, testsTotal)
+		}
+
+		if !sliceutil.IsStringInSlice(msg, printedLogs) {
+			log.Printf(msg)
+			printedLogs = append(printedLogs, msg)
+		}
+
+		if finished {
+			if err := forEachMatrix(matrices, func(matrix *TestMatrixRun) error {
+				return updateTestMatrixTestCases(configs, matrix)
+			}); err != nil {
+				log.Warnf("Failed to get the test cases, error: %s", err)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return newStepError(errorCategoryTimeout, "The test did not finish in %s, %d of %d test execution(s) still running", timeout, testsRunning, testsTotal)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// forEachMatrix calls fn concurrently for every matrix and returns the first error.
+func forEachMatrix(matrices []*TestMatrixRun, fn func(*TestMatrixRun) error) error {
+	errs := make([]error, len(matrices))
+	var wg sync.WaitGroup
+	for i, matrix := range matrices {
+		wg.Add(1)
+		go func(i int, matrix *TestMatrixRun) {
+			defer wg.Done()
+			errs[i] = fn(matrix)
+		}(i, matrix)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forTestType returns a copy of the specification, which runs only the given test type.
+func (spec TestSpecification) forTestType(testType string) *TestSpecification {
+	testSpecification := spec
+	testSpecification.AndroidInstrumentationTest = nil
+	testSpecification.AndroidRoboTest = nil
+	testSpecification.AndroidTestLoop = nil
+	testSpecification.IosXcTest = nil
+
+	switch testType {
+	case "instrumentation":
+		instrumentationTest := *spec.AndroidInstrumentationTest
+		testSpecification.AndroidInstrumentationTest = &instrumentationTest
+	case "robo":
+		testSpecification.AndroidRoboTest = spec.AndroidRoboTest
+	case "gameloop":
+		testSpecification.AndroidTestLoop = spec.AndroidTestLoop
+	case "ios_xctest":
+		// the Android test setup does not apply to iOS devices
+		testSpecification.IosXcTest = spec.IosXcTest
+		testSpecification.TestSetup = nil
+		testSpecification.AutoGoogleLogin = false
+	}
+	return &testSpecification
+}
+
+// updateTestMatrixSteps fetches the current state of the matrix's steps.
+func updateTestMatrixSteps(configs ConfigsModel, matrix *TestMatrixRun) error {
+	req, err := http.NewRequest("GET", matrix.url(configs), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create http request, error: %s", err)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to get http response, error: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response body, error: %s", err)
+	}
+
+	responseModel := &ListStepsResponse{}
+	if err := json.Unmarshal(body, responseModel); err != nil {
+		return fmt.Errorf("Failed to unmarshal response body, error: %s, body: %s", err, string(body))
+	}
+
+	matrix.Steps = responseModel.Steps
+	return nil
+}
+
+// testCasesURL is the url of a page of the step's test cases, the first page has no page token.
+func (matrix TestMatrixRun) testCasesURL(configs ConfigsModel, stepID, pageToken string) string {
+	query := url.Values{}
+	if matrix.ID != "" {
+		query.Set("matrix_id", matrix.ID)
+	}
+	query.Set("step_id", stepID)
+	if pageToken != "" {
+		query.Set("page_token", pageToken)
+	}
+	return configs.APIBaseURL + "/testcases/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken + "?" + query.Encode()
+}
+
+// updateTestMatrixTestCases fetches the test cases of the matrix's test execution steps,
+// the steps listing only reports the test suite overviews.
+func updateTestMatrixTestCases(configs ConfigsModel, matrix *TestMatrixRun) error {
+	for _, step := range matrix.Steps {
+		if step.TestExecution == nil || step.StepID == "" || step.TestCases != nil {
+			continue
+		}
+
+		testCases := []*TestCase{}
+		pageToken := ""
+		for {
+			responseModel, err := getTestCasesPage(matrix.testCasesURL(configs, step.StepID, pageToken))
+			if err != nil {
+				return err
+			}
+			testCases = append(testCases, responseModel.TestCases...)
+
+			if responseModel.NextPageToken == "" || responseModel.NextPageToken == pageToken {
+				break
+			}
+			pageToken = responseModel.NextPageToken
+		}
+		step.TestCases = testCases
+	}
+	return nil
+}
+
+func getTestCasesPage(testCasesURL string) (*ListTestCasesResponse, error) {
+	req, err := http.NewRequest("GET", testCasesURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create http request, error: %s", err)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get http response, error: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get http response, status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body, error: %s", err)
+	}
+
+	responseModel := &ListTestCasesResponse{}
+	if err := json.Unmarshal(body, responseModel); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal response body, error: %s, body: %s", err, string(body))
+	}
+	return responseModel, nil
+}
+
+// matrixResults returns the device results of every matrix.
+// The results are labeled with the test type if more test types were run,
+// and with the test APK's name if more test APKs were run.
+func matrixResults(matrices []*TestMatrixRun) []*DeviceResult {
+	testTypes := []string{}
+	instrumentationMatrices := 0
+	for _, matrix := range matrices {
+		if !sliceutil.IsStringInSlice(matrix.TestType, testTypes) {
+			testTypes = append(testTypes, matrix.TestType)
+		}
+		if matrix.TestType == "instrumentation" {
+			instrumentationMatrices++
+		}
+	}
+
+	results := []*DeviceResult{}
+	for _, matrix := range matrices {
+		for _, result := range groupStepsByDevice(matrix.Steps) {
+			result.matrixRun = matrix.origin()
+			result.History = []*Outcome{result.Outcome}
+			if !matrix.FailedTestsOnly {
+				result.completeSteps = result.Steps
+			}
+			if len(testTypes) > 1 {
+				result.TestType = matrix.TestType
+			}
+			if matrix.TestType == "instrumentation" && instrumentationMatrices > 1 {
+				result.Matrix = matrix.Name
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// shouldRerun returns true if the device's outcome may be fixed by rerunning it.
+func shouldRerun(result *DeviceResult) bool {
+	return result.Outcome.Summary == "failure" || result.Outcome.Summary == "inconclusive"
+}
+
+// rerunMatrices returns the matrices rerunning the failed and inconclusive devices of the results.
+// If failedTestsOnly is set, instrumentation tests rerun only the failed test cases, if these are known.
+func rerunMatrices(results []*DeviceResult, attempt int, failedTestsOnly bool) []*TestMatrixRun {
+	origins := []*TestMatrixRun{}
+	failedResults := map[*TestMatrixRun][]*DeviceResult{}
+	for _, result := range results {
+		if !shouldRerun(result) {
+			continue
+		}
+		if _, ok := failedResults[result.matrixRun]; !ok {
+			origins = append(origins, result.matrixRun)
+		}
+		failedResults[result.matrixRun] = append(failedResults[result.matrixRun], result)
+	}
+
+	reruns := []*TestMatrixRun{}
+	for _, origin := range origins {
+		failedDevices := map[string]bool{}
+		for _, result := range failedResults[origin] {
+			failedDevices[deviceKey(result.Dimensions)] = true
+		}
+
+		environmentMatrix := origin.Model.EnvironmentMatrix.filterDevices(failedDevices)
+		if environmentMatrix.numDevices() == 0 {
+			continue
+		}
+
+		testSpecification := *origin.Model.TestSpecification
+		rerunFailedTestsOnly := false
+		if failedTestsOnly && testSpecification.AndroidInstrumentationTest != nil {
+			if targets := failedTestTargets(failedResults[origin]); len(targets) > 0 {
+				instrumentationTest := *testSpecification.AndroidInstrumentationTest
+				instrumentationTest.TestTargets = targets
+				instrumentationTest.ShardingOption = nil
+				testSpecification.AndroidInstrumentationTest = &instrumentationTest
+				rerunFailedTestsOnly = true
+			}
+		}
+
+		reruns = append(reruns, &TestMatrixRun{
+			ID:       origin.rerunID(attempt),
+			Name:     origin.Name,
+			TestType: origin.TestType,
+			Model: &TestMatrix{
+				EnvironmentMatrix: environmentMatrix,
+				FlakyTestAttempts: origin.Model.FlakyTestAttempts,
+				TestSpecification: &testSpecification,
+			},
+			Attempt:         attempt,
+			Origin:          origin,
+			FailedTestsOnly: rerunFailedTestsOnly,
+		})
+	}
+	return reruns
+}
+
+// filterDevices returns a copy of the environment matrix with the devices of the given device keys.
+func (environment EnvironmentMatrix) filterDevices(keys map[string]bool) *EnvironmentMatrix {
+	filtered := &EnvironmentMatrix{}
+	if environment.AndroidDeviceList != nil {
+		filtered.AndroidDeviceList = &AndroidDeviceList{}
+		for _, device := range environment.AndroidDeviceList.AndroidDevices {
+			if keys[device.key()] {
+				filtered.AndroidDeviceList.AndroidDevices = append(filtered.AndroidDeviceList.AndroidDevices, device)
+			}
+		}
+	}
+	if environment.IosDeviceList != nil {
+		filtered.IosDeviceList = &IosDeviceList{}
+		for _, device := range environment.IosDeviceList.IosDevices {
+			if keys[device.key()] {
+				filtered.IosDeviceList.IosDevices = append(filtered.IosDeviceList.IosDevices, device)
+			}
+		}
+	}
+	return filtered
+}
+
+func (environment EnvironmentMatrix) numDevices() int {
+	count := 0
+	if environment.AndroidDeviceList != nil {
+		count += len(environment.AndroidDeviceList.AndroidDevices)
+	}
+	if environment.IosDeviceList != nil {
+		count += len(environment.IosDeviceList.IosDevices)
+	}
+	return count
+}
+
+// failedTestTargets returns the failed test cases of the devices' steps in the format of the test targets.
+func failedTestTargets(results []*DeviceResult) []string {
+	targets := []string{}
+	for _, result := range results {
+		for _, step := range result.Steps {
+			for _, testCase := range step.TestCases {
+				if testCase.Status != "failed" && testCase.Status != "error" {
+					continue
+				}
+				if testCase.TestCaseReference == nil || testCase.TestCaseReference.ClassName == "" {
+					continue
+				}
+				target := "class " + testCase.TestCaseReference.ClassName
+				if testCase.TestCaseReference.Name != "" {
+					target += "#" + testCase.TestCaseReference.Name
+				}
+				if !sliceutil.IsStringInSlice(target, targets) {
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// mergeRerunResults replaces the outcome of the rerun devices, and records the outcome in the devices' attempt history.
+// A rerun of the failed test cases only does not replace the steps counting the devices' executed test cases.
+func mergeRerunResults(results []*DeviceResult, rerunResults []*DeviceResult) {
+	for _, rerunResult := range rerunResults {
+		for _, result := range results {
+			if result.matrixRun != rerunResult.matrixRun || deviceKey(result.Dimensions) != deviceKey(rerunResult.Dimensions) {
+				continue
+			}
+			result.Outcome = rerunResult.Outcome
+			result.Steps = rerunResult.Steps
+			if rerunResult.completeSteps != nil {
+				result.completeSteps = rerunResult.completeSteps
+			}
+			result.History = append(result.History, rerunResult.Outcome)
+		}
+	}
+}
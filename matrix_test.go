@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeRerunResults(t *testing.T) {
+	instrumentation := &TestMatrixRun{ID: "instrumentation", TestType: "instrumentation"}
+	robo := &TestMatrixRun{ID: "robo", TestType: "robo"}
+	pixel := map[string]string{"Model": "Pixel2", "Version": "28", "Locale": "en", "Orientation": "portrait"}
+	nexus := map[string]string{"Model": "Nexus5", "Version": "23", "Locale": "en", "Orientation": "portrait"}
+
+	success := &Outcome{Summary: "success"}
+	failure := &Outcome{Summary: "failure"}
+	newResult := func(matrix *TestMatrixRun, dimensions map[string]string, outcome *Outcome) *DeviceResult {
+		return &DeviceResult{matrixRun: matrix, Dimensions: dimensions, Outcome: outcome, History: []*Outcome{outcome}}
+	}
+
+	tests := []struct {
+		name         string
+		results      []*DeviceResult
+		rerunResults []*DeviceResult
+		wantOutcomes []string
+		wantHistory  [][]string
+	}{
+		{
+			name:         "rerun device replaces the outcome",
+			results:      []*DeviceResult{newResult(instrumentation, pixel, success), newResult(instrumentation, nexus, failure)},
+			rerunResults: []*DeviceResult{newResult(instrumentation, nexus, success)},
+			wantOutcomes: []string{"success", "success"},
+			wantHistory:  [][]string{{"success"}, {"failure", "success"}},
+		},
+		{
+			name:         "the same device of another matrix is kept",
+			results:      []*DeviceResult{newResult(instrumentation, nexus, failure), newResult(robo, nexus, failure)},
+			rerunResults: []*DeviceResult{newResult(robo, nexus, success)},
+			wantOutcomes: []string{"failure", "success"},
+			wantHistory:  [][]string{{"failure"}, {"failure", "success"}},
+		},
+		{
+			name:         "no rerun results",
+			results:      []*DeviceResult{newResult(instrumentation, nexus, failure)},
+			rerunResults: nil,
+			wantOutcomes: []string{"failure"},
+			wantHistory:  [][]string{{"failure"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mergeRerunResults(tt.results, tt.rerunResults)
+
+			outcomes := []string{}
+			history := [][]string{}
+			for _, result := range tt.results {
+				outcomes = append(outcomes, result.Outcome.Summary)
+				attempts := []string{}
+				for _, outcome := range result.History {
+					attempts = append(attempts, outcome.Summary)
+				}
+				history = append(history, attempts)
+			}
+			if !reflect.DeepEqual(outcomes, tt.wantOutcomes) {
+				t.Errorf("mergeRerunResults() outcomes = %v, want %v", outcomes, tt.wantOutcomes)
+			}
+			if !reflect.DeepEqual(history, tt.wantHistory) {
+				t.Errorf("mergeRerunResults() history = %v, want %v", history, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestRerunFailedTestsOnlyTestCount(t *testing.T) {
+	dimensions := []*StepDimensionValueEntry{{Key: "Model", Value: "Pixel2"}, {Key: "Version", Value: "28"}, {Key: "Locale", Value: "en"}, {Key: "Orientation", Value: "portrait"}}
+	newStep := func(outcome string, testCount int, testCases ...*TestCase) *Step {
+		return &Step{
+			State:          "complete",
+			DimensionValue: dimensions,
+			Outcome:        &Outcome{Summary: outcome},
+			TestExecution:  &TestExecutionStep{TestSuiteOverviews: []*TestSuiteOverview{{TotalCount: testCount}}},
+			TestCases:      testCases,
+		}
+	}
+	failedTestCase := &TestCase{Status: "failed", TestCaseReference: &TestCaseReference{ClassName: "com.example.LoginTest", Name: "testLogin"}}
+
+	tests := []struct {
+		name            string
+		failedTestsOnly bool
+		rerunTestCount  int
+		wantTestCount   int
+		wantSuccessful  bool
+	}{
+		{name: "rerun of the failed test cases keeps the test count", failedTestsOnly: true, rerunTestCount: 1, wantTestCount: 50, wantSuccessful: true},
+		{name: "rerun of every test case replaces the test count", failedTestsOnly: false, rerunTestCount: 50, wantTestCount: 50, wantSuccessful: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matrix := &TestMatrixRun{
+				TestType: "instrumentation",
+				Model: &TestMatrix{
+					EnvironmentMatrix: &EnvironmentMatrix{AndroidDeviceList: &AndroidDeviceList{AndroidDevices: []*AndroidDevice{
+						{AndroidModelID: "Pixel2", AndroidVersionID: "28", Locale: "en", Orientation: "portrait"},
+					}}},
+					TestSpecification: &TestSpecification{AndroidInstrumentationTest: &AndroidInstrumentationTest{}},
+				},
+				Steps: []*Step{newStep("failure", 50, failedTestCase)},
+			}
+			results := matrixResults([]*TestMatrixRun{matrix})
+
+			reruns := rerunMatrices(results, 1, tt.failedTestsOnly)
+			if len(reruns) != 1 || reruns[0].FailedTestsOnly != tt.failedTestsOnly {
+				t.Fatalf("rerunMatrices() = %v, want a single rerun with FailedTestsOnly = %v", reruns, tt.failedTestsOnly)
+			}
+			reruns[0].Steps = []*Step{newStep("success", tt.rerunTestCount)}
+			mergeRerunResults(results, matrixResults(reruns))
+
+			if got := results[0].testCount(); got != tt.wantTestCount {
+				t.Errorf("testCount() = %d, want %d", got, tt.wantTestCount)
+			}
+			if verdict := (FailurePolicy{MinTestCount: 10}).apply(results); verdict.Successful != tt.wantSuccessful {
+				t.Errorf("apply() successful = %v, want %v", verdict.Successful, tt.wantSuccessful)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/sliceutil"
+)
+
+const (
+	policyActionFail   = "fail"
+	policyActionWarn   = "warn"
+	policyActionIgnore = "ignore"
+)
+
+var policyActionSeverity = map[string]int{
+	policyActionIgnore: 1,
+	policyActionWarn:   2,
+	policyActionFail:   3,
+}
+
+// policyOutcomeDetails are the outcome summaries the failure policy applies to, with their detail flags.
+var policyOutcomeDetails = map[string][]string{
+	"failure":      {"Crashed", "NotInstalled", "OtherNativeCrash", "TimedOut", "UnableToCrawl"},
+	"inconclusive": {"AbortedByUser", "InfrastructureFailure"},
+	"skipped":      {"IncompatibleAppVersion", "IncompatibleArchitecture", "IncompatibleDevice"},
+}
+
+// FailurePolicy decides which device outcomes fail the step.
+type FailurePolicy struct {
+	// Rules map an outcome summary (e.g. skipped) or a summary and detail flag (e.g. skipped:IncompatibleDevice)
+	// to an action, the outcomes without rule fail the step.
+	Rules map[string]string
+	// MaxFailedPercent is the percentage of the devices allowed to fail without failing the step.
+	MaxFailedPercent float64
+	FlakyPolicy      string
+	// MinTestCount is the number of test cases the passed devices have to execute, 0 disables the check.
+	MinTestCount int
+}
+
+// PolicyVerdict is the result of applying the failure policy to the device results.
+type PolicyVerdict struct {
+	Successful bool
+	Failed     []*DeviceResult
+	Warned     []*DeviceResult
+}
+
+// failurePolicy parses the failure policy, the max failed devices percent and the minimum test count inputs.
+func (configs ConfigsModel) failurePolicy() (FailurePolicy, error) {
+	policy := FailurePolicy{FlakyPolicy: configs.FlakyTestPolicy}
+
+	var err error
+	if policy.Rules, err = parseFailurePolicyRules(configs.FailurePolicy); err != nil {
+		return FailurePolicy{}, fmt.Errorf("Issue with FailurePolicy: %s", err)
+	}
+	if policy.MaxFailedPercent, err = parseMaxFailedPercent(configs.MaxFailedPercent); err != nil {
+		return FailurePolicy{}, fmt.Errorf("Issue with MaxFailedPercent: %s", err)
+	}
+	if configs.MinTestCount != "" {
+		if policy.MinTestCount, err = strconv.Atoi(configs.MinTestCount); err != nil {
+			return FailurePolicy{}, fmt.Errorf("Issue with MinTestCount: failed to parse string(%s) to integer, error: %s", configs.MinTestCount, err)
+		}
+		if policy.MinTestCount < 0 {
+			return FailurePolicy{}, fmt.Errorf("Issue with MinTestCount: can not be negative")
+		}
+	}
+	return policy, nil
+}
+
+// parseFailurePolicyRules parses the rules, one outcome[:detail]=action per line,
+// e.g. skipped:IncompatibleDevice=ignore
+func parseFailurePolicyRules(value string) (map[string]string, error) {
+	rules := map[string]string{}
+	for _, line := range parseLines(value) {
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid rule (%s), the format is: outcome[:detail]=fail|warn|ignore", line)
+		}
+		key := strings.TrimSpace(split[0])
+		action := strings.TrimSpace(split[1])
+
+		keySplit := strings.SplitN(key, ":", 2)
+		details, ok := policyOutcomeDetails[keySplit[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid outcome (%s) in rule (%s), available outcomes: failure, inconclusive, skipped", keySplit[0], line)
+		}
+		if len(keySplit) == 2 && !sliceutil.IsStringInSlice(keySplit[1], details) {
+			return nil, fmt.Errorf("invalid %s detail (%s) in rule (%s), available details: %s", keySplit[0], keySplit[1], line, strings.Join(details, ", "))
+		}
+		if _, ok := policyActionSeverity[action]; !ok {
+			return nil, fmt.Errorf("invalid action (%s) in rule (%s), available actions: fail, warn, ignore", action, line)
+		}
+		if _, ok := rules[key]; ok {
+			return nil, fmt.Errorf("rule for (%s) specified more than once", key)
+		}
+		rules[key] = action
+	}
+	return rules, nil
+}
+
+// parseMaxFailedPercent parses a percentage between 0 and 100.
+func parseMaxFailedPercent(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse (%s) to a percentage, error: %s", value, err)
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("has to be between 0 and 100")
+	}
+	return percent, nil
+}
+
+// parseDeviceKeys parses device configurations in the format of the test devices,
+// one model,version,locale,orientation[,required|optional] per line.
+func parseDeviceKeys(value string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, line := range parseLines(value) {
+		params, _, err := parseTestDevice(line)
+		if err != nil {
+			return nil, err
+		}
+		keys[testDeviceKey(params)] = true
+	}
+	return keys, nil
+}
+
+// testDeviceKey returns the device key of the parsed test device configuration.
+func testDeviceKey(params []string) string {
+	return deviceKey(map[string]string{"Model": params[0], "Version": params[1], "Locale": params[2], "Orientation": params[3]})
+}
+
+const (
+	deviceGroupRequired = "required"
+	deviceGroupOptional = "optional"
+)
+
+// parseTestDevice parses a test device configuration: model,version,locale,orientation[,required|optional]
+func parseTestDevice(line string) ([]string, string, error) {
+	params := strings.Split(line, ",")
+	if len(params) != 4 && len(params) != 5 {
+		return nil, "", fmt.Errorf("invalid test device configuration: %s", line)
+	}
+	for i := range params {
+		params[i] = strings.TrimSpace(params[i])
+	}
+
+	group := deviceGroupRequired
+	if len(params) == 5 {
+		group = params[4]
+		if group != deviceGroupRequired && group != deviceGroupOptional {
+			return nil, "", fmt.Errorf("invalid device group (%s) of test device (%s), available groups: required, optional", group, line)
+		}
+	}
+	return params[:4], group, nil
+}
+
+// optionalDeviceKeys returns the device keys of the devices tagged as optional in the test devices,
+// and of the devices listed in the optional devices.
+func (configs ConfigsModel) optionalDeviceKeys() (map[string]bool, error) {
+	keys, err := parseDeviceKeys(configs.OptionalDevices)
+	if err != nil {
+		return nil, fmt.Errorf("Issue with OptionalDevices: %s", err)
+	}
+	for _, line := range parseLines(configs.TestDevices) {
+		params, group, err := parseTestDevice(line)
+		if err != nil {
+			return nil, fmt.Errorf("Issue with TestDevices: %s", err)
+		}
+		if group == deviceGroupOptional {
+			keys[testDeviceKey(params)] = true
+		}
+	}
+	return keys, nil
+}
+
+// markOptionalDevices sets the optional flag of the results of the given devices.
+func markOptionalDevices(results []*DeviceResult, keys map[string]bool) {
+	for _, result := range results {
+		result.Optional = keys[deviceKey(result.Dimensions)]
+	}
+}
+
+// action returns the policy's action for the device. A passed device below the minimum test count fails,
+// the failures of the optional devices only warn.
+func (policy FailurePolicy) action(result *DeviceResult) string {
+	action := policy.outcomeAction(result)
+	if policy.belowMinTestCount(result) {
+		action = policyActionFail
+	}
+	if action == policyActionFail && result.Optional {
+		return policyActionWarn
+	}
+	return action
+}
+
+// belowMinTestCount returns true if the device passed, but executed fewer test cases than the minimum.
+// The devices with unknown test count are not checked.
+func (policy FailurePolicy) belowMinTestCount(result *DeviceResult) bool {
+	if policy.MinTestCount <= 0 || !result.reportsTestCount() {
+		return false
+	}
+	if result.Outcome.Summary != "success" && result.Outcome.Summary != "flaky" {
+		return false
+	}
+	return result.testCount() < policy.MinTestCount
+}
+
+// describe returns the device's outcome, extended with the executed test count if it is below the minimum.
+func (policy FailurePolicy) describe(result *DeviceResult) string {
+	text := outcomeText(result.Outcome)
+	if policy.belowMinTestCount(result) {
+		text += fmt.Sprintf(", executed %d of the expected %d test(s)", result.testCount(), policy.MinTestCount)
+	}
+	return text
+}
+
+// outcomeAction returns the policy's action for the device's outcome.
+// If the outcome has more detail flags, the most severe action of these applies.
+func (policy FailurePolicy) outcomeAction(result *DeviceResult) string {
+	action := policyActionIgnore
+	switch result.Outcome.Summary {
+	case "success":
+		return policyActionIgnore
+	case "flaky":
+		switch policy.FlakyPolicy {
+		case flakyPolicyFailure:
+			action = policyActionFail
+		case flakyPolicyWarning:
+			action = policyActionWarn
+		}
+	default:
+		summaryAction, ok := policy.Rules[result.Outcome.Summary]
+		if !ok {
+			summaryAction = policyActionFail
+		}
+
+		details := outcomeDetails(result.Outcome)
+		if len(details) == 0 {
+			action = summaryAction
+		}
+		for _, detail := range details {
+			detailAction, ok := policy.Rules[result.Outcome.Summary+":"+detail]
+			if !ok {
+				detailAction = summaryAction
+			}
+			if policyActionSeverity[detailAction] > policyActionSeverity[action] {
+				action = detailAction
+			}
+		}
+	}
+	return action
+}
+
+// apply returns the failed and warned devices, the step fails if the failed devices exceed the allowed percentage
+// of the required devices. The optional devices never fail, so these do not count in the percentage.
+func (policy FailurePolicy) apply(results []*DeviceResult) PolicyVerdict {
+	verdict := PolicyVerdict{Successful: true}
+	requiredDevices := 0
+	for _, result := range results {
+		if !result.Optional {
+			requiredDevices++
+		}
+		switch policy.action(result) {
+		case policyActionFail:
+			verdict.Failed = append(verdict.Failed, result)
+		case policyActionWarn:
+			verdict.Warned = append(verdict.Warned, result)
+		}
+	}
+
+	if len(verdict.Failed) > 0 && float64(len(verdict.Failed))*100 > policy.MaxFailedPercent*float64(requiredDevices) {
+		verdict.Successful = false
+	}
+	return verdict
+}
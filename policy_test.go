@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFailurePolicyApply(t *testing.T) {
+	newResult := func(model string, outcome *Outcome, testCount int) *DeviceResult {
+		return &DeviceResult{
+			Dimensions: map[string]string{"Model": model},
+			Outcome:    outcome,
+			Steps: []*Step{{
+				Outcome:       outcome,
+				TestExecution: &TestExecutionStep{TestSuiteOverviews: []*TestSuiteOverview{{TotalCount: testCount}}},
+			}},
+			matrixRun: &TestMatrixRun{TestType: "instrumentation"},
+		}
+	}
+	optional := func(result *DeviceResult) *DeviceResult {
+		result.Optional = true
+		return result
+	}
+	success := &Outcome{Summary: "success"}
+	flaky := &Outcome{Summary: "flaky"}
+	crashed := &Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true}}
+	incompatible := &Outcome{Summary: "skipped", SkippedDetail: &SkippedDetail{IncompatibleDevice: true}}
+
+	tests := []struct {
+		name           string
+		policy         FailurePolicy
+		results        []*DeviceResult
+		wantSuccessful bool
+		wantFailed     []string
+		wantWarned     []string
+	}{
+		{
+			name:           "every device passed",
+			policy:         FailurePolicy{},
+			results:        []*DeviceResult{newResult("a", success, 3), newResult("b", success, 3)},
+			wantSuccessful: true,
+		},
+		{
+			name:           "failure fails without rule",
+			policy:         FailurePolicy{},
+			results:        []*DeviceResult{newResult("a", success, 3), newResult("b", crashed, 3)},
+			wantSuccessful: false,
+			wantFailed:     []string{"b"},
+		},
+		{
+			name:           "detail rule overrides the summary rule",
+			policy:         FailurePolicy{Rules: map[string]string{"skipped": policyActionFail, "skipped:IncompatibleDevice": policyActionIgnore}},
+			results:        []*DeviceResult{newResult("a", incompatible, 0)},
+			wantSuccessful: true,
+		},
+		{
+			name:           "warning rule",
+			policy:         FailurePolicy{Rules: map[string]string{"failure": policyActionWarn}},
+			results:        []*DeviceResult{newResult("a", crashed, 3)},
+			wantSuccessful: true,
+			wantWarned:     []string{"a"},
+		},
+		{
+			name:           "flaky policy",
+			policy:         FailurePolicy{FlakyPolicy: flakyPolicyFailure},
+			results:        []*DeviceResult{newResult("a", flaky, 3)},
+			wantSuccessful: false,
+			wantFailed:     []string{"a"},
+		},
+		{
+			name:           "failed devices within the allowed percent",
+			policy:         FailurePolicy{MaxFailedPercent: 50},
+			results:        []*DeviceResult{newResult("a", success, 3), newResult("b", crashed, 3)},
+			wantSuccessful: true,
+			wantFailed:     []string{"b"},
+		},
+		{
+			name:           "failed devices above the allowed percent",
+			policy:         FailurePolicy{MaxFailedPercent: 49},
+			results:        []*DeviceResult{newResult("a", success, 3), newResult("b", crashed, 3)},
+			wantSuccessful: false,
+			wantFailed:     []string{"b"},
+		},
+		{
+			name:   "optional devices do not count in the allowed percent",
+			policy: FailurePolicy{MaxFailedPercent: 50},
+			results: []*DeviceResult{
+				newResult("a", success, 3), newResult("b", crashed, 3), newResult("c", crashed, 3),
+				optional(newResult("d", success, 3)), optional(newResult("e", success, 3)), optional(newResult("f", success, 3)),
+			},
+			wantSuccessful: false,
+			wantFailed:     []string{"b", "c"},
+		},
+		{
+			name:           "optional device failure warns",
+			policy:         FailurePolicy{},
+			results:        []*DeviceResult{newResult("a", success, 3), optional(newResult("b", crashed, 3))},
+			wantSuccessful: true,
+			wantWarned:     []string{"b"},
+		},
+		{
+			name:           "passed device below the minimum test count fails",
+			policy:         FailurePolicy{MinTestCount: 2},
+			results:        []*DeviceResult{newResult("a", success, 3), newResult("b", success, 1)},
+			wantSuccessful: false,
+			wantFailed:     []string{"b"},
+		},
+		{
+			name:           "optional device below the minimum test count warns",
+			policy:         FailurePolicy{MinTestCount: 2},
+			results:        []*DeviceResult{optional(newResult("a", success, 0))},
+			wantSuccessful: true,
+			wantWarned:     []string{"a"},
+		},
+		{
+			name:   "unknown test count is not checked",
+			policy: FailurePolicy{MinTestCount: 2},
+			results: []*DeviceResult{{
+				Dimensions: map[string]string{"Model": "a"},
+				Outcome:    success,
+				Steps:      []*Step{{Outcome: success}},
+				matrixRun:  &TestMatrixRun{TestType: "instrumentation"},
+			}},
+			wantSuccessful: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict := tt.policy.apply(tt.results)
+			if verdict.Successful != tt.wantSuccessful {
+				t.Errorf("apply() successful = %v, want %v", verdict.Successful, tt.wantSuccessful)
+			}
+			if got := resultModels(verdict.Failed); !reflect.DeepEqual(got, tt.wantFailed) {
+				t.Errorf("apply() failed = %v, want %v", got, tt.wantFailed)
+			}
+			if got := resultModels(verdict.Warned); !reflect.DeepEqual(got, tt.wantWarned) {
+				t.Errorf("apply() warned = %v, want %v", got, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func resultModels(results []*DeviceResult) []string {
+	var models []string
+	for _, result := range results {
+		models = append(models, result.Dimensions["Model"])
+	}
+	return models
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitrise-io/go-utils/colorstring"
+)
+
+// outcomeSeverity orders the outcome summaries, the most severe outcome of a device's steps
+// becomes the device's outcome.
+// A flaky outcome is a success, which was reached only by rerunning a failed attempt.
+var outcomeSeverity = map[string]int{
+	"success":      1,
+	"flaky":        2,
+	"skipped":      3,
+	"inconclusive": 4,
+	"failure":      5,
+}
+
+const (
+	flakyPolicySuccess = "success"
+	flakyPolicyWarning = "warning"
+	flakyPolicyFailure = "failure"
+)
+
+// deviceDimensionKeys identify a device configuration among the step dimensions.
+var deviceDimensionKeys = []string{"Model", "Version", "Locale", "Orientation"}
+
+// DeviceResult is the merged result of a device configuration's steps.
+// Sharded runs report one step per shard and game loop runs one step per scenario,
+// these are merged back into one result per device.
+type DeviceResult struct {
+	// TestType is set if the step ran more than one test type.
+	TestType string
+	// Matrix is the name of the test matrix the device ran in, it is set if the step ran more than one test APK.
+	Matrix     string
+	Dimensions map[string]string
+	Outcome    *Outcome
+	Steps      []*Step
+	// History holds the outcome of every attempt, the first run's followed by the reruns'.
+	History []*Outcome
+	// Optional devices are reported, but their failures do not fail the step.
+	Optional bool
+
+	// matrixRun is the first run's matrix of the device, the Matrix field is its name.
+	matrixRun *TestMatrixRun
+	// completeSteps are the steps of the last attempt, which ran every test case of the device.
+	completeSteps []*Step
+}
+
+// isSharded returns true if the device configuration was run in shards.
+func (result DeviceResult) isSharded() bool {
+	for _, step := range result.Steps {
+		if shardIndex(step) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScenarios returns true if the device configuration reported game loop scenario results.
+func (result DeviceResult) hasScenarios() bool {
+	for _, step := range result.Steps {
+		if stepDimensions(step)["Scenario"] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRetries returns true if any of the device configuration's test executions was rerun as a flaky test attempt.
+func (result DeviceResult) hasRetries() bool {
+	for _, step := range result.Steps {
+		if attemptNumber(step) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsTestCount returns true if the device ran a test type, which reports the executed test cases.
+func (result DeviceResult) supportsTestCount() bool {
+	return result.matrixRun != nil && (result.matrixRun.TestType == "instrumentation" || result.matrixRun.TestType == "ios_xctest")
+}
+
+// testCountSteps returns the steps counting the executed test cases, a rerun of the failed test cases only does not count.
+func (result DeviceResult) testCountSteps() []*Step {
+	if result.completeSteps != nil {
+		return result.completeSteps
+	}
+	return result.Steps
+}
+
+// reportsTestCount returns true if the device's test type reports the executed test cases,
+// and the last attempt of every shard reported these. Otherwise the device's test count is unknown.
+func (result DeviceResult) reportsTestCount() bool {
+	if !result.supportsTestCount() {
+		return false
+	}
+	for _, attempts := range groupStepAttempts(result.testCountSteps()) {
+		if attempts[len(attempts)-1].TestExecution == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// testCount returns the number of test cases the device executed,
+// counting only the last attempt of every shard.
+func (result DeviceResult) testCount() int {
+	count := 0
+	for _, attempts := range groupStepAttempts(result.testCountSteps()) {
+		step := attempts[len(attempts)-1]
+		if step.TestExecution == nil {
+			continue
+		}
+		for _, overview := range step.TestExecution.TestSuiteOverviews {
+			count += overview.TotalCount
+		}
+	}
+	return count
+}
+
+// testCases returns the test case results of the device, reported by the last attempt of every shard.
+func (result DeviceResult) testCases() []*TestCase {
+	testCases := []*TestCase{}
+	for _, attempts := range groupStepAttempts(result.Steps) {
+		for _, testCase := range attempts[len(attempts)-1].TestCases {
+			if testCase.TestCaseReference != nil {
+				testCases = append(testCases, testCase)
+			}
+		}
+	}
+	return testCases
+}
+
+// failedTestCases returns the test cases of the device with failed or error status.
+func (result DeviceResult) failedTestCases() []*TestCase {
+	failed := []*TestCase{}
+	for _, testCase := range result.testCases() {
+		if testCase.failed() {
+			failed = append(failed, testCase)
+		}
+	}
+	return failed
+}
+
+func (testCase TestCase) failed() bool {
+	return testCase.Status == "failed" || testCase.Status == "error"
+}
+
+// name returns the test case's class and method name, e.g. com.example.LoginTest#testLogin
+func (testCase TestCase) name() string {
+	if testCase.TestCaseReference == nil {
+		return ""
+	}
+	if testCase.TestCaseReference.ClassName == "" {
+		return testCase.TestCaseReference.Name
+	}
+	return testCase.TestCaseReference.ClassName + "#" + testCase.TestCaseReference.Name
+}
+
+// stackTrace returns the test case's stack traces, separated by an empty line.
+func (testCase TestCase) stackTrace() string {
+	exceptions := []string{}
+	for _, stackTrace := range testCase.StackTraces {
+		if stackTrace != nil && stackTrace.Exception != "" {
+			exceptions = append(exceptions, strings.TrimSpace(stackTrace.Exception))
+		}
+	}
+	return strings.Join(exceptions, "\n\n")
+}
+
+// devicesWithUnknownTestCount returns the devices, which ran a test type reporting the executed test cases,
+// but not every shard reported these.
+func devicesWithUnknownTestCount(results []*DeviceResult) []*DeviceResult {
+	unknown := []*DeviceResult{}
+	for _, result := range results {
+		if result.supportsTestCount() && !result.reportsTestCount() && result.Outcome.Summary != "skipped" {
+			unknown = append(unknown, result)
+		}
+	}
+	return unknown
+}
+
+// deviceName returns the device's dimensions, prefixed with the test type and matrix name if set,
+// e.g. instrumentation app-debug-androidTest.apk Pixel2 28 en portrait
+func deviceName(result *DeviceResult) string {
+	parts := []string{}
+	if result.TestType != "" {
+		parts = append(parts, result.TestType)
+	}
+	if result.Matrix != "" {
+		parts = append(parts, result.Matrix)
+	}
+	for _, key := range deviceDimensionKeys {
+		parts = append(parts, result.Dimensions[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (duration *Duration) duration() time.Duration {
+	if duration == nil {
+		return 0
+	}
+	return time.Duration(duration.Seconds)*time.Second + time.Duration(duration.Nanos)
+}
+
+func stepDimensions(step *Step) map[string]string {
+	dimensions := map[string]string{}
+	for _, dimension := range step.DimensionValue {
+		dimensions[dimension.Key] = dimension.Value
+	}
+	return dimensions
+}
+
+// key returns the device's key matching the deviceKey of its steps' dimensions.
+func (device AndroidDevice) key() string {
+	return deviceKey(map[string]string{
+		"Model":       device.AndroidModelID,
+		"Version":     device.AndroidVersionID,
+		"Locale":      device.Locale,
+		"Orientation": device.Orientation,
+	})
+}
+
+// key returns the device's key matching the deviceKey of its steps' dimensions.
+func (device IosDevice) key() string {
+	return deviceKey(map[string]string{
+		"Model":       device.IosModelID,
+		"Version":     device.IosVersionID,
+		"Locale":      device.Locale,
+		"Orientation": device.Orientation,
+	})
+}
+
+func deviceKey(dimensions map[string]string) string {
+	values := []string{}
+	for _, key := range deviceDimensionKeys {
+		values = append(values, dimensions[key])
+	}
+	return strings.Join(values, "-")
+}
+
+// groupStepsByDevice merges the steps of the same device configuration, keeping the order of the devices' first steps.
+func groupStepsByDevice(steps []*Step) []*DeviceResult {
+	results := []*DeviceResult{}
+	resultByKey := map[string]*DeviceResult{}
+	for _, step := range steps {
+		dimensions := stepDimensions(step)
+		key := deviceKey(dimensions)
+
+		result, ok := resultByKey[key]
+		if !ok {
+			result = &DeviceResult{Dimensions: dimensions}
+			resultByKey[key] = result
+			results = append(results, result)
+		}
+		result.Steps = append(result.Steps, step)
+	}
+
+	for _, result := range results {
+		sort.SliceStable(result.Steps, func(i, j int) bool {
+			if shardIndex(result.Steps[i]) != shardIndex(result.Steps[j]) {
+				return shardIndex(result.Steps[i]) < shardIndex(result.Steps[j])
+			}
+			if scenarioNumber(result.Steps[i]) != scenarioNumber(result.Steps[j]) {
+				return scenarioNumber(result.Steps[i]) < scenarioNumber(result.Steps[j])
+			}
+			return attemptNumber(result.Steps[i]) < attemptNumber(result.Steps[j])
+		})
+
+		outcomes := []*Outcome{}
+		for _, attempts := range groupStepAttempts(result.Steps) {
+			outcomes = append(outcomes, mergeAttempts(attempts))
+		}
+		result.Outcome = mergeOutcomes(outcomes)
+	}
+	return results
+}
+
+// attemptNumber returns the step's flaky test attempt, 0 is the first attempt.
+func attemptNumber(step *Step) int64 {
+	if step.MultiStep == nil {
+		return 0
+	}
+	return step.MultiStep.MultistepNumber
+}
+
+// groupStepAttempts groups the sorted steps of a device by shard and scenario,
+// every group holds the attempts of the same test execution.
+func groupStepAttempts(steps []*Step) [][]*Step {
+	groups := [][]*Step{}
+	for i, step := range steps {
+		if i > 0 && shardIndex(step) == shardIndex(steps[i-1]) && scenarioNumber(step) == scenarioNumber(steps[i-1]) {
+			groups[len(groups)-1] = append(groups[len(groups)-1], step)
+			continue
+		}
+		groups = append(groups, []*Step{step})
+	}
+	return groups
+}
+
+// mergeAttempts returns the outcome of a test execution's attempts:
+// flaky if an attempt succeeded after a failed one, otherwise the most severe outcome.
+func mergeAttempts(attempts []*Step) *Outcome {
+	successes := []*Outcome{}
+	outcomes := []*Outcome{}
+	for _, attempt := range attempts {
+		if attempt.Outcome != nil && attempt.Outcome.Summary == "success" {
+			successes = append(successes, attempt.Outcome)
+		}
+		outcomes = append(outcomes, attempt.Outcome)
+	}
+
+	switch {
+	case len(successes) == 0:
+		return mergeOutcomes(outcomes)
+	case len(successes) < len(attempts):
+		return &Outcome{Summary: "flaky"}
+	}
+	return mergeOutcomes(successes)
+}
+
+// shardIndex returns the step's shard index from the Shard dimension, or -1 for non sharded steps.
+func shardIndex(step *Step) int {
+	index, err := strconv.Atoi(stepDimensions(step)["Shard"])
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// scenarioNumber returns the step's game loop scenario from the Scenario dimension, or -1 for non game loop steps.
+func scenarioNumber(step *Step) int {
+	scenario, err := strconv.Atoi(stepDimensions(step)["Scenario"])
+	if err != nil {
+		return -1
+	}
+	return scenario
+}
+
+// mergeOutcomes returns the most severe outcome, with the details of every outcome of the same severity.
+func mergeOutcomes(outcomes []*Outcome) *Outcome {
+	merged := &Outcome{}
+	for _, outcome := range outcomes {
+		if outcome == nil {
+			continue
+		}
+		if outcomeSeverity[outcome.Summary] > outcomeSeverity[merged.Summary] {
+			merged = &Outcome{Summary: outcome.Summary}
+		}
+		if outcome.Summary != merged.Summary {
+			continue
+		}
+
+		if outcome.FailureDetail != nil {
+			if merged.FailureDetail == nil {
+				merged.FailureDetail = &FailureDetail{}
+			}
+			merged.FailureDetail.Crashed = merged.FailureDetail.Crashed || outcome.FailureDetail.Crashed
+			merged.FailureDetail.NotInstalled = merged.FailureDetail.NotInstalled || outcome.FailureDetail.NotInstalled
+			merged.FailureDetail.OtherNativeCrash = merged.FailureDetail.OtherNativeCrash || outcome.FailureDetail.OtherNativeCrash
+			merged.FailureDetail.TimedOut = merged.FailureDetail.TimedOut || outcome.FailureDetail.TimedOut
+			merged.FailureDetail.UnableToCrawl = merged.FailureDetail.UnableToCrawl || outcome.FailureDetail.UnableToCrawl
+		}
+		if outcome.InconclusiveDetail != nil {
+			if merged.InconclusiveDetail == nil {
+				merged.InconclusiveDetail = &InconclusiveDetail{}
+			}
+			merged.InconclusiveDetail.AbortedByUser = merged.InconclusiveDetail.AbortedByUser || outcome.InconclusiveDetail.AbortedByUser
+			merged.InconclusiveDetail.InfrastructureFailure = merged.InconclusiveDetail.InfrastructureFailure || outcome.InconclusiveDetail.InfrastructureFailure
+		}
+		if outcome.SkippedDetail != nil {
+			if merged.SkippedDetail == nil {
+				merged.SkippedDetail = &SkippedDetail{}
+			}
+			merged.SkippedDetail.IncompatibleAppVersion = merged.SkippedDetail.IncompatibleAppVersion || outcome.SkippedDetail.IncompatibleAppVersion
+			merged.SkippedDetail.IncompatibleArchitecture = merged.SkippedDetail.IncompatibleArchitecture || outcome.SkippedDetail.IncompatibleArchitecture
+			merged.SkippedDetail.IncompatibleDevice = merged.SkippedDetail.IncompatibleDevice || outcome.SkippedDetail.IncompatibleDevice
+		}
+		if outcome.SuccessDetail != nil {
+			if merged.SuccessDetail == nil {
+				merged.SuccessDetail = &SuccessDetail{}
+			}
+			merged.SuccessDetail.OtherNativeCrash = merged.SuccessDetail.OtherNativeCrash || outcome.SuccessDetail.OtherNativeCrash
+		}
+	}
+	return merged
+}
+
+// outcomeDetails returns the names of the detail flags set for the outcome's summary.
+func outcomeDetails(outcome *Outcome) []string {
+	details := []string{}
+	if outcome == nil {
+		return details
+	}
+
+	switch outcome.Summary {
+	case "failure":
+		if outcome.FailureDetail != nil {
+			if outcome.FailureDetail.Crashed {
+				details = append(details, "Crashed")
+			}
+			if outcome.FailureDetail.NotInstalled {
+				details = append(details, "NotInstalled")
+			}
+			if outcome.FailureDetail.OtherNativeCrash {
+				details = append(details, "OtherNativeCrash")
+			}
+			if outcome.FailureDetail.TimedOut {
+				details = append(details, "TimedOut")
+			}
+			if outcome.FailureDetail.UnableToCrawl {
+				details = append(details, "UnableToCrawl")
+			}
+		}
+	case "inconclusive":
+		if outcome.InconclusiveDetail != nil {
+			if outcome.InconclusiveDetail.AbortedByUser {
+				details = append(details, "AbortedByUser")
+			}
+			if outcome.InconclusiveDetail.InfrastructureFailure {
+				details = append(details, "InfrastructureFailure")
+			}
+		}
+	case "skipped":
+		if outcome.SkippedDetail != nil {
+			if outcome.SkippedDetail.IncompatibleAppVersion {
+				details = append(details, "IncompatibleAppVersion")
+			}
+			if outcome.SkippedDetail.IncompatibleArchitecture {
+				details = append(details, "IncompatibleArchitecture")
+			}
+			if outcome.SkippedDetail.IncompatibleDevice {
+				details = append(details, "IncompatibleDevice")
+			}
+		}
+	}
+	return details
+}
+
+// outcomeText returns the outcome summary followed by its details, e.g. failure(Crashed)
+func outcomeText(outcome *Outcome) string {
+	if outcome == nil {
+		return ""
+	}
+
+	text := outcome.Summary
+	for _, detail := range outcomeDetails(outcome) {
+		text += "(" + detail + ")"
+	}
+	return text
+}
+
+// formatOutcome returns the colored outcomeText.
+func formatOutcome(outcome *Outcome) string {
+	if outcome == nil {
+		return ""
+	}
+
+	text := outcomeText(outcome)
+
+	switch outcome.Summary {
+	case "success":
+		return colorstring.Green(text)
+	case "flaky":
+		return colorstring.Magenta(text)
+	case "failure":
+		return colorstring.Red(text)
+	case "inconclusive":
+		return colorstring.Yellow(text)
+	case "skipped":
+		return colorstring.Blue(text)
+	}
+	return text
+}
+
+// countOutcome returns the number of devices with the given outcome summary.
+func countOutcome(results []*DeviceResult, summary string) int {
+	count := 0
+	for _, result := range results {
+		if result.Outcome.Summary == summary {
+			count++
+		}
+	}
+	return count
+}
+
+// printResults writes one row per device, followed by the per shard and per scenario outcomes.
+func printResults(out io.Writer, results []*DeviceResult) {
+	rerun := hasReruns(results)
+	testCount := hasTestCountColumn(results)
+	optional := hasOptionalDevices(results)
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	header := deviceHeader(results) + "Outcome\t"
+	if testCount {
+		header += "Tests\t"
+	}
+	if rerun {
+		header += "Attempts\t"
+	}
+	if optional {
+		header += "Group\t"
+	}
+	fmt.Fprintln(w, header)
+	for _, result := range results {
+		columns := deviceColumns(results, result) + formatOutcome(result.Outcome) + "\t"
+		if testCount {
+			if result.reportsTestCount() {
+				columns += strconv.Itoa(result.testCount()) + "\t"
+			} else {
+				columns += "-\t"
+			}
+		}
+		if rerun {
+			columns += formatHistory(result.History) + "\t"
+		}
+		if optional {
+			columns += result.group() + "\t"
+		}
+		fmt.Fprintln(w, columns)
+	}
+	w.Flush()
+
+	printStepResults(out, "Shard", results, DeviceResult.isSharded, func(step *Step) string {
+		return strconv.Itoa(shardIndex(step))
+	})
+	printStepResults(out, "Scenario", results, DeviceResult.hasScenarios, func(step *Step) string {
+		return stepDimensions(step)["Scenario"]
+	})
+	printStepResults(out, "Attempt", results, DeviceResult.hasRetries, func(step *Step) string {
+		return strconv.FormatInt(attemptNumber(step)+1, 10)
+	})
+	printFailingTests(out, results)
+}
+
+// hasOptionalDevices returns true if any of the devices is optional.
+func hasOptionalDevices(results []*DeviceResult) bool {
+	for _, result := range results {
+		if result.Optional {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the device's group: required or optional.
+func (result DeviceResult) group() string {
+	if result.Optional {
+		return deviceGroupOptional
+	}
+	return deviceGroupRequired
+}
+
+// maxPrintedStackTraceLines limits the printed stack trace of a failing test, the reports contain the whole stack trace.
+const maxPrintedStackTraceLines = 10
+
+// printFailingTests writes the failed test cases of every device, with the beginning of their stack traces.
+func printFailingTests(out io.Writer, results []*DeviceResult) {
+	printedHeader := false
+	for _, result := range results {
+		failed := result.failedTestCases()
+		if len(failed) == 0 {
+			continue
+		}
+		if !printedHeader {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "Failing tests:")
+			printedHeader = true
+		}
+
+		fmt.Fprintf(out, "%s:\n", deviceName(result))
+		for _, testCase := range failed {
+			fmt.Fprintf(out, "  - %s (%s)\n", colorstring.Red(testCase.name()), testCase.Status)
+			lines := strings.Split(testCase.stackTrace(), "\n")
+			if len(lines) == 1 && lines[0] == "" {
+				continue
+			}
+			if len(lines) > maxPrintedStackTraceLines {
+				lines = append(lines[:maxPrintedStackTraceLines], fmt.Sprintf("... (%d more lines)", len(lines)-maxPrintedStackTraceLines))
+			}
+			for _, line := range lines {
+				fmt.Fprintf(out, "      %s\n", line)
+			}
+		}
+	}
+}
+
+func hasTestCountColumn(results []*DeviceResult) bool {
+	for _, result := range results {
+		if result.supportsTestCount() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasReruns(results []*DeviceResult) bool {
+	for _, result := range results {
+		if len(result.History) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// formatHistory returns the outcome summaries of the attempts, e.g. failure -> success
+func formatHistory(history []*Outcome) string {
+	summaries := []string{}
+	for _, outcome := range history {
+		summaries = append(summaries, outcome.Summary)
+	}
+	return strings.Join(summaries, " -> ")
+}
+
+// hasIosResults returns true if the results belong to an iOS test, which can not be combined with Android tests.
+func hasIosResults(results []*DeviceResult) bool {
+	for _, result := range results {
+		if result.matrixRun != nil && result.matrixRun.TestType == "ios_xctest" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMatrixColumn(results []*DeviceResult) bool {
+	for _, result := range results {
+		if result.Matrix != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTestTypeColumn(results []*DeviceResult) bool {
+	for _, result := range results {
+		if result.TestType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceHeader returns the header of the columns identifying a device's result.
+func deviceHeader(results []*DeviceResult) string {
+	header := "Model\tAPI Level\tLocale\tOrientation\t"
+	if hasIosResults(results) {
+		header = "Model\tiOS Version\tLocale\tOrientation\t"
+	}
+	if hasMatrixColumn(results) {
+		header = "Test\t" + header
+	}
+	if hasTestTypeColumn(results) {
+		header = "Test type\t" + header
+	}
+	return header
+}
+
+// deviceColumns returns the columns identifying the device's result, matching the deviceHeader.
+func deviceColumns(results []*DeviceResult, result *DeviceResult) string {
+	columns := fmt.Sprintf("%s\t%s\t%s\t%s\t", result.Dimensions["Model"], result.Dimensions["Version"], result.Dimensions["Locale"], result.Dimensions["Orientation"])
+	if hasMatrixColumn(results) {
+		columns = result.Matrix + "\t" + columns
+	}
+	if hasTestTypeColumn(results) {
+		columns = result.TestType + "\t" + columns
+	}
+	return columns
+}
+
+// printStepResults writes the outcome of every step of the devices selected by the filter,
+// the steps are identified by the given column's value.
+func printStepResults(out io.Writer, column string, results []*DeviceResult, filter func(DeviceResult) bool, value func(*Step) string) {
+	selected := []*DeviceResult{}
+	for _, result := range results {
+		if filter(*result) {
+			selected = append(selected, result)
+		}
+	}
+	if len(selected) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s results:\n", column)
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, deviceHeader(results)+column+"\tOutcome\t")
+	for _, result := range selected {
+		for _, step := range result.Steps {
+			fmt.Fprintln(w, deviceColumns(results, result)+value(step)+"\t"+formatOutcome(step.Outcome)+"\t")
+		}
+	}
+	w.Flush()
+}
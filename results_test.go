@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeAttempts(t *testing.T) {
+	success := &Outcome{Summary: "success"}
+	crashed := &Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true}}
+	timedOut := &Outcome{Summary: "failure", FailureDetail: &FailureDetail{TimedOut: true}}
+	infrastructureFailure := &Outcome{Summary: "inconclusive", InconclusiveDetail: &InconclusiveDetail{InfrastructureFailure: true}}
+
+	tests := []struct {
+		name     string
+		outcomes []*Outcome
+		want     *Outcome
+	}{
+		{
+			name:     "single success",
+			outcomes: []*Outcome{success},
+			want:     &Outcome{Summary: "success"},
+		},
+		{
+			name:     "every attempt succeeded",
+			outcomes: []*Outcome{success, success},
+			want:     &Outcome{Summary: "success"},
+		},
+		{
+			name:     "success after failure is flaky",
+			outcomes: []*Outcome{crashed, success},
+			want:     &Outcome{Summary: "flaky"},
+		},
+		{
+			name:     "failure after success is flaky",
+			outcomes: []*Outcome{success, infrastructureFailure},
+			want:     &Outcome{Summary: "flaky"},
+		},
+		{
+			name:     "failures merge the details",
+			outcomes: []*Outcome{crashed, timedOut},
+			want:     &Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true, TimedOut: true}},
+		},
+		{
+			name:     "the most severe outcome",
+			outcomes: []*Outcome{infrastructureFailure, crashed},
+			want:     &Outcome{Summary: "failure", FailureDetail: &FailureDetail{Crashed: true}},
+		},
+		{
+			name:     "unfinished attempt without outcome",
+			outcomes: []*Outcome{nil},
+			want:     &Outcome{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := []*Step{}
+			for _, outcome := range tt.outcomes {
+				attempts = append(attempts, &Step{Outcome: outcome})
+			}
+			if got := mergeAttempts(attempts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeAttempts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
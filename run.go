@@ -0,0 +1,882 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/bitrise-tools/go-steputils/tools"
+)
+
+// testRun holds the state shared by the phases of the step.
+type testRun struct {
+	configs ConfigsModel
+
+	// additional files are uploaded in order: additional APKs first, then the files to push, the robo script,
+	// the test APKs except the first one and the xctestrun file
+	additionalApkPaths  []string
+	filesToPush         []FileToPush
+	testApkPaths        []string
+	additionalFilePaths []string
+	roboScriptIndex     int
+	testApkIndex        int
+	xcTestRunIndex      int
+
+	appBundle       *AppBundle
+	xcTestZip       *FileReference
+	additionalFiles []*AdditionalFile
+
+	policy FailurePolicy
+	// optionalDevices are the device keys of the optional devices
+	optionalDevices map[string]bool
+
+	matrices []*TestMatrixRun
+	// reruns are the started matrices of the failed devices' reruns
+	reruns  []*TestMatrixRun
+	results []*DeviceResult
+	// finished is true if every matrix finished, including the reruns
+	finished bool
+	// successful is the verdict of the evaluated results
+	successful bool
+	// failureCategory is the error category of the unsuccessful test
+	failureCategory string
+
+	junitReportPath string
+	assetsPath      string
+	assets          []string
+	// failedAssets are the test assets failed to download
+	failedAssets []string
+}
+
+func newTestRun(configs ConfigsModel) *testRun {
+	return &testRun{
+		configs:         configs,
+		roboScriptIndex: -1,
+		xcTestRunIndex:  -1,
+		successful:      true,
+		failureCategory: errorCategoryTestFailure,
+	}
+}
+
+// execute runs the phases of the step in order, until the first failing phase.
+func (run *testRun) execute() error {
+	phases := []func() error{run.prepare, run.upload, run.startTest, run.waitForResults, run.evaluateResults}
+	for _, phase := range phases {
+		if err := phase(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare validates the inputs and collects the files to upload.
+func (run *testRun) prepare() error {
+	configs := run.configs
+	if err := configs.validate(); err != nil {
+		return newStepError(errorCategoryConfiguration, "%s", err)
+	}
+	policy, err := configs.failurePolicy()
+	if err != nil {
+		return newStepError(errorCategoryConfiguration, "%s", err)
+	}
+	run.policy = policy
+	if run.optionalDevices, err = configs.optionalDeviceKeys(); err != nil {
+		return newStepError(errorCategoryConfiguration, "%s", err)
+	}
+
+	run.additionalApkPaths = parseLines(configs.AdditionalApks)
+	filesToPush, err := configs.filesToPush()
+	if err != nil {
+		return newStepError(errorCategoryConfiguration, "Failed to parse files to push, error: %s", err)
+	}
+	run.filesToPush = filesToPush
+	if configs.hasTestType("instrumentation") {
+		run.testApkPaths, err = configs.testApkPaths()
+		if err != nil {
+			return newStepError(errorCategoryConfiguration, "Failed to find test APKs, error: %s", err)
+		}
+	}
+	run.additionalFilePaths = append([]string{}, run.additionalApkPaths...)
+	for _, file := range run.filesToPush {
+		run.additionalFilePaths = append(run.additionalFilePaths, file.LocalPath)
+	}
+	if configs.hasTestType("robo") && configs.RoboScriptPath != "" {
+		run.roboScriptIndex = len(run.additionalFilePaths)
+		run.additionalFilePaths = append(run.additionalFilePaths, configs.RoboScriptPath)
+	}
+	// the first test APK is uploaded to the test app URL, the others as additional files
+	run.testApkIndex = len(run.additionalFilePaths)
+	if len(run.testApkPaths) > 1 {
+		run.additionalFilePaths = append(run.additionalFilePaths, run.testApkPaths[1:]...)
+	}
+	if configs.hasTestType("ios_xctest") && configs.XcTestRunPath != "" {
+		run.xcTestRunIndex = len(run.additionalFilePaths)
+		run.additionalFilePaths = append(run.additionalFilePaths, configs.XcTestRunPath)
+	}
+	return nil
+}
+
+// upload uploads the app, the test APK and the additional files.
+func (run *testRun) upload() error {
+	configs := run.configs
+	// the xctest zip is uploaded in place of the app
+	appPath := configs.ApkPath
+	appType := detectAppType(configs.ApkPath)
+	if configs.hasTestType("ios_xctest") {
+		appPath = configs.XcTestZipPath
+		appType = appTypeXcTest
+	}
+
+	fmt.Println()
+	log.Infof("Upload APKs")
+	{
+		url := configs.APIBaseURL + "/assets/" + configs.AppSlug + "/" + configs.BuildSlug + "/" + configs.APIToken
+
+		var reqBody io.Reader
+		if len(run.additionalFilePaths) > 0 || appType != appTypeApk {
+			assetsUploadRequest := AssetsUploadRequest{}
+			if appType != appTypeApk {
+				assetsUploadRequest.AppType = appType
+			}
+			for _, path := range run.additionalFilePaths {
+				assetsUploadRequest.AdditionalFiles = append(assetsUploadRequest.AdditionalFiles, filepath.Base(path))
+			}
+
+			jsonByte, err := json.Marshal(assetsUploadRequest)
+			if err != nil {
+				return newStepError(errorCategoryUpload, "Failed to marshal assets upload request, error: %s", err)
+			}
+			reqBody = bytes.NewBuffer(jsonByte)
+		}
+
+		req, err := http.NewRequest("POST", url, reqBody)
+		if err != nil {
+			return newStepError(errorCategoryInfrastructure, "Failed to create http request, error: %s", err)
+		}
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			return newStepError(errorCategoryInfrastructure, "Failed to get http response, error: %s", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Printf("Failed to close response body: %s", err)
+			}
+		}()
+
+		if resp.StatusCode != http.StatusOK {
+			return newStepError(errorCategoryInfrastructure, "Failed to get http response, status code: %d", resp.StatusCode)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return newStepError(errorCategoryInfrastructure, "Failed to read response body, error: %s", err)
+		}
+
+		responseModel := &UploadURLRequest{}
+
+		err = json.Unmarshal(body, responseModel)
+		if err != nil {
+			return newStepError(errorCategoryInfrastructure, "Failed to unmarshal response body, error: %s", err)
+		}
+
+		err = uploadFile(responseModel.AppURL, appPath)
+		if err != nil {
+			return newStepError(errorCategoryUpload, "Failed to upload file(%s) to (%s), error: %s", appPath, responseModel.AppURL, err)
+		}
+		switch appType {
+		case appTypeBundle:
+			if responseModel.AppGcsPath == "" {
+				return newStepError(errorCategoryUpload, "Failed to get the storage path of the uploaded app bundle")
+			}
+			run.appBundle = &AppBundle{BundleLocation: &FileReference{GcsPath: responseModel.AppGcsPath}}
+		case appTypeXcTest:
+			if responseModel.AppGcsPath == "" {
+				return newStepError(errorCategoryUpload, "Failed to get the storage path of the uploaded xctest zip")
+			}
+			run.xcTestZip = &FileReference{GcsPath: responseModel.AppGcsPath}
+		}
+		if len(run.testApkPaths) > 0 {
+			err = uploadFile(responseModel.TestAppURL, run.testApkPaths[0])
+			if err != nil {
+				return newStepError(errorCategoryUpload, "Failed to upload file(%s) to (%s), error: %s", run.testApkPaths[0], responseModel.TestAppURL, err)
+			}
+		}
+
+		if len(responseModel.AdditionalFiles) != len(run.additionalFilePaths) {
+			return newStepError(errorCategoryUpload, "Failed to get upload URLs for additional files, requested: %d, received: %d", len(run.additionalFilePaths), len(responseModel.AdditionalFiles))
+		}
+		for i, path := range run.additionalFilePaths {
+			additionalFile := responseModel.AdditionalFiles[i]
+			err = uploadFile(additionalFile.UploadURL, path)
+			if err != nil {
+				return newStepError(errorCategoryUpload, "Failed to upload file(%s) to (%s), error: %s", path, additionalFile.UploadURL, err)
+			}
+		}
+		run.additionalFiles = responseModel.AdditionalFiles
+
+		log.Donef("=> APKs uploaded")
+	}
+	return nil
+}
+
+// startTest creates and starts the test matrices.
+func (run *testRun) startTest() error {
+	configs := run.configs
+	fmt.Println()
+	log.Infof("Start test")
+	{
+		testModel := &TestMatrix{}
+		if configs.hasTestType("ios_xctest") {
+			testModel.EnvironmentMatrix = &EnvironmentMatrix{IosDeviceList: &IosDeviceList{}}
+			testModel.EnvironmentMatrix.IosDeviceList.IosDevices = []*IosDevice{}
+		} else {
+			testModel.EnvironmentMatrix = &EnvironmentMatrix{AndroidDeviceList: &AndroidDeviceList{}}
+			testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices = []*AndroidDevice{}
+		}
+
+		scanner := bufio.NewScanner(strings.NewReader(configs.TestDevices))
+		for scanner.Scan() {
+			device := scanner.Text()
+			device = strings.TrimSpace(device)
+			if device == "" {
+				continue
+			}
+
+			deviceParams, _, err := parseTestDevice(device)
+			if err != nil {
+				return newStepError(errorCategoryConfiguration, "%s", err)
+			}
+
+			if testModel.EnvironmentMatrix.IosDeviceList != nil {
+				newDevice := IosDevice{
+					IosModelID:   deviceParams[0],
+					IosVersionID: deviceParams[1],
+					Locale:       deviceParams[2],
+					Orientation:  deviceParams[3],
+				}
+
+				testModel.EnvironmentMatrix.IosDeviceList.IosDevices = append(testModel.EnvironmentMatrix.IosDeviceList.IosDevices, &newDevice)
+				continue
+			}
+
+			newDevice := AndroidDevice{
+				AndroidModelID:   deviceParams[0],
+				AndroidVersionID: deviceParams[1],
+				Locale:           deviceParams[2],
+				Orientation:      deviceParams[3],
+			}
+
+			testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices = append(testModel.EnvironmentMatrix.AndroidDeviceList.AndroidDevices, &newDevice)
+		}
+
+		// parse directories to pull
+		scanner = bufio.NewScanner(strings.NewReader(configs.DirectoriesToPull))
+		directoriesToPull := []string{}
+		for scanner.Scan() {
+			path := scanner.Text()
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+			directoriesToPull = append(directoriesToPull, path)
+		}
+
+		// parse environment variables
+		envs := []*EnvironmentVariable{}
+		for _, envStr := range parseLines(configs.EnvironmentVariables) {
+			if !strings.Contains(envStr, "=") {
+				continue
+			}
+
+			envStrSplit := strings.Split(envStr, "=")
+			envKey := envStrSplit[0]
+			envValue := strings.Join(envStrSplit[1:], "=")
+
+			envs = append(envs, &EnvironmentVariable{Key: envKey, Value: envValue})
+		}
+
+		// see additionalFilePaths for the order of the additional files
+		additionalApks := []*Apk{}
+		for i := range run.additionalApkPaths {
+			additionalApks = append(additionalApks, &Apk{Location: &FileReference{GcsPath: run.additionalFiles[i].GcsPath}})
+		}
+
+		deviceFiles := []*DeviceFile{}
+		for i, file := range run.filesToPush {
+			content := &FileReference{GcsPath: run.additionalFiles[len(run.additionalApkPaths)+i].GcsPath}
+			if file.isObb() {
+				deviceFiles = append(deviceFiles, &DeviceFile{ObbFile: &ObbFile{Obb: content, ObbFileName: filepath.Base(file.LocalPath)}})
+			} else {
+				deviceFiles = append(deviceFiles, &DeviceFile{RegularFile: &RegularFile{Content: content, DevicePath: file.DevicePath}})
+			}
+		}
+
+		testModel.TestSpecification = &TestSpecification{
+			AutoGoogleLogin:           configs.AutoGoogleLogin == "true",
+			DisablePerformanceMetrics: configs.PerformanceMetrics == "false",
+			DisableVideoRecording:     configs.RecordVideo == "false",
+			TestTimeout:               fmt.Sprintf("%ss", configs.TestTimeout),
+			TestSetup: &TestSetup{
+				AdditionalApks:       additionalApks,
+				EnvironmentVariables: envs,
+				DirectoriesToPull:    directoriesToPull,
+				FilesToPush:          deviceFiles,
+			},
+		}
+
+		for _, testType := range configs.testTypes() {
+			switch testType {
+			case "instrumentation":
+				testModel.TestSpecification.AndroidInstrumentationTest = &AndroidInstrumentationTest{AppBundle: run.appBundle}
+				if configs.AppPackageID != "" {
+					testModel.TestSpecification.AndroidInstrumentationTest.AppPackageID = configs.AppPackageID
+				}
+				// the test package ID belongs to a single test APK, the API reads it from the test APKs' manifest otherwise
+				if configs.InstTestPackageID != "" && len(run.testApkPaths) > 1 {
+					log.Warnf("The test package ID (%s) is ignored, %d test APKs are set", configs.InstTestPackageID, len(run.testApkPaths))
+				} else if configs.InstTestPackageID != "" {
+					testModel.TestSpecification.AndroidInstrumentationTest.TestPackageID = configs.InstTestPackageID
+				}
+				if configs.InstTestRunnerClass != "" {
+					testModel.TestSpecification.AndroidInstrumentationTest.TestRunnerClass = configs.InstTestRunnerClass
+				}
+				if configs.InstTestTargets != "" {
+					targets := strings.Split(strings.TrimSpace(configs.InstTestTargets), ",")
+					testModel.TestSpecification.AndroidInstrumentationTest.TestTargets = targets
+				}
+				if configs.InstUseOrchestrator == "true" {
+					testModel.TestSpecification.AndroidInstrumentationTest.OrchestratorOption = "USE_ORCHESTRATOR"
+				} else {
+					testModel.TestSpecification.AndroidInstrumentationTest.OrchestratorOption = "DO_NOT_USE_ORCHESTRATOR"
+				}
+				if configs.InstNumUniformShards != "" {
+					numShards, err := strconv.Atoi(configs.InstNumUniformShards)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.InstNumUniformShards, err)
+					}
+					testModel.TestSpecification.AndroidInstrumentationTest.ShardingOption = &ShardingOption{UniformSharding: &UniformSharding{NumShards: int64(numShards)}}
+				}
+				if configs.InstManualShards != "" {
+					manualSharding := &ManualSharding{}
+					for _, targets := range parseManualShards(configs.InstManualShards) {
+						manualSharding.TestTargetsForShard = append(manualSharding.TestTargetsForShard, &TestTargetsForShard{TestTargets: targets})
+					}
+					testModel.TestSpecification.AndroidInstrumentationTest.ShardingOption = &ShardingOption{ManualSharding: manualSharding}
+				}
+			case "robo":
+				testModel.TestSpecification.AndroidRoboTest = &AndroidRoboTest{AppBundle: run.appBundle}
+				if configs.AppPackageID != "" {
+					testModel.TestSpecification.AndroidRoboTest.AppPackageID = configs.AppPackageID
+				}
+				if configs.RoboInitialActivity != "" {
+					testModel.TestSpecification.AndroidRoboTest.AppInitialActivity = configs.RoboInitialActivity
+				}
+				if configs.RoboMaxDepth != "" {
+					maxDepth, err := strconv.Atoi(configs.RoboMaxDepth)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.RoboMaxDepth, err)
+					}
+					testModel.TestSpecification.AndroidRoboTest.MaxDepth = int64(maxDepth)
+				}
+				if configs.RoboMaxSteps != "" {
+					maxSteps, err := strconv.Atoi(configs.RoboMaxSteps)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.RoboMaxSteps, err)
+					}
+					testModel.TestSpecification.AndroidRoboTest.MaxSteps = int64(maxSteps)
+				}
+				if configs.RoboDirectives != "" {
+					roboDirectives, err := parseRoboDirectives(configs.RoboDirectives)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse robo directives, error: %s", err)
+					}
+					testModel.TestSpecification.AndroidRoboTest.RoboDirectives = roboDirectives
+				}
+				// sign-in credentials are entered by Robo as ENTER_TEXT directives
+				if configs.RoboUsernameResource != "" {
+					testModel.TestSpecification.AndroidRoboTest.RoboDirectives = append(testModel.TestSpecification.AndroidRoboTest.RoboDirectives, &RoboDirective{ResourceName: configs.RoboUsernameResource, InputText: configs.RoboUsername, ActionType: "ENTER_TEXT"})
+				}
+				if configs.RoboPasswordResource != "" {
+					testModel.TestSpecification.AndroidRoboTest.RoboDirectives = append(testModel.TestSpecification.AndroidRoboTest.RoboDirectives, &RoboDirective{ResourceName: configs.RoboPasswordResource, InputText: configs.RoboPassword, ActionType: "ENTER_TEXT"})
+				}
+				if run.roboScriptIndex >= 0 {
+					testModel.TestSpecification.AndroidRoboTest.RoboScript = &FileReference{GcsPath: run.additionalFiles[run.roboScriptIndex].GcsPath}
+				}
+			case "gameloop":
+				testModel.TestSpecification.AndroidTestLoop = &AndroidTestLoop{AppBundle: run.appBundle}
+				if configs.AppPackageID != "" {
+					testModel.TestSpecification.AndroidTestLoop.AppPackageID = configs.AppPackageID
+				}
+				if configs.LoopScenarios != "" {
+					loopScenarios, err := parseLoopScenarios(configs.LoopScenarios)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse loop scenarios, error: %s", err)
+					}
+					testModel.TestSpecification.AndroidTestLoop.Scenarios = loopScenarios
+				}
+				if configs.LoopScenarioLabels != "" {
+					scenarioLabels, err := parseLoopScenarioLabels(configs.LoopScenarioLabels)
+					if err != nil {
+						return newStepError(errorCategoryConfiguration, "Failed to parse loop scenario labels, error: %s", err)
+					}
+					testModel.TestSpecification.AndroidTestLoop.ScenarioLabels = scenarioLabels
+				}
+			case "ios_xctest":
+				testModel.TestSpecification.IosXcTest = &IosXcTest{TestsZip: run.xcTestZip, XcodeVersion: configs.XcodeVersion}
+				if run.xcTestRunIndex >= 0 {
+					testModel.TestSpecification.IosXcTest.Xctestrun = &FileReference{GcsPath: run.additionalFiles[run.xcTestRunIndex].GcsPath}
+				}
+			}
+		}
+
+		runnerArguments, err := parseRunnerArguments(configs.InstRunnerArguments)
+		if err != nil {
+			return newStepError(errorCategoryConfiguration, "Failed to parse runner arguments, error: %s", err)
+		}
+
+		// every test APK runs in its own matrix, with the same app and devices
+		instrumentationMatrices := []*TestMatrixRun{}
+		for i, testApkPath := range run.testApkPaths {
+			testSpecification := testModel.TestSpecification.forTestType("instrumentation")
+			instrumentationTest := testSpecification.AndroidInstrumentationTest
+
+			matrix := &TestMatrixRun{
+				Name:     filepath.Base(testApkPath),
+				TestType: "instrumentation",
+				Model:    &TestMatrix{EnvironmentMatrix: testModel.EnvironmentMatrix, TestSpecification: testSpecification},
+			}
+			if len(run.testApkPaths) > 1 {
+				matrix.ID = fmt.Sprintf("test-apk-%d", i)
+			}
+			// TestLab passes the test environment variables to the instrumentation runner as -e key value arguments
+			if len(runnerArguments) > 0 || configs.InstClearPackageData == "true" {
+				testSetup := *testSpecification.TestSetup
+				testSetup.EnvironmentVariables = append(append([]*EnvironmentVariable{}, testSetup.EnvironmentVariables...), runnerArguments...)
+				if configs.InstClearPackageData == "true" {
+					testSetup.EnvironmentVariables = append(testSetup.EnvironmentVariables, &EnvironmentVariable{Key: "clearPackageData", Value: "true"})
+				}
+				testSpecification.TestSetup = &testSetup
+			}
+			if i > 0 {
+				instrumentationTest.TestApk = &FileReference{GcsPath: run.additionalFiles[run.testApkIndex+i-1].GcsPath}
+			}
+
+			if configs.InstNumBalancedShards != "" {
+				numShards, err := strconv.Atoi(configs.InstNumBalancedShards)
+				if err != nil {
+					return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.InstNumBalancedShards, err)
+				}
+
+				matrix.ShardPlan, err = planBalancedShards(testApkPath, configs.InstShardHistoryDir, configs.InstTestClassPattern, numShards)
+				if err != nil {
+					return newStepError(errorCategoryConfiguration, "Failed to plan balanced shards for (%s), error: %s", testApkPath, err)
+				}
+
+				if matrix.ShardPlan == nil {
+					log.Warnf("No test duration history found in (%s), using %d uniform shards for (%s)", configs.InstShardHistoryDir, numShards, matrix.Name)
+					instrumentationTest.ShardingOption = &ShardingOption{UniformSharding: &UniformSharding{NumShards: int64(numShards)}}
+				} else {
+					log.Printf("Test classes of (%s) are distributed into %d shards based on the test duration history", matrix.Name, len(matrix.ShardPlan.Shards))
+					manualSharding := &ManualSharding{}
+					for _, targets := range matrix.ShardPlan.testTargets() {
+						manualSharding.TestTargetsForShard = append(manualSharding.TestTargetsForShard, &TestTargetsForShard{TestTargets: targets})
+					}
+					instrumentationTest.ShardingOption = &ShardingOption{ManualSharding: manualSharding}
+				}
+			}
+
+			instrumentationMatrices = append(instrumentationMatrices, matrix)
+		}
+
+		// every test type runs in its own matrix, the app is uploaded once
+		for _, testType := range configs.testTypes() {
+			if testType == "instrumentation" {
+				run.matrices = append(run.matrices, instrumentationMatrices...)
+				continue
+			}
+			run.matrices = append(run.matrices, &TestMatrixRun{
+				Name:     testType,
+				TestType: testType,
+				Model:    &TestMatrix{EnvironmentMatrix: testModel.EnvironmentMatrix, TestSpecification: testModel.TestSpecification.forTestType(testType)},
+			})
+		}
+
+		if configs.FlakyTestAttempts != "" {
+			flakyTestAttempts, err := strconv.Atoi(configs.FlakyTestAttempts)
+			if err != nil {
+				return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.FlakyTestAttempts, err)
+			}
+			for _, matrix := range run.matrices {
+				matrix.Model.FlakyTestAttempts = int64(flakyTestAttempts)
+			}
+		}
+
+		if len(run.matrices) > 1 {
+			for _, matrix := range run.matrices {
+				if matrix.ID == "" {
+					matrix.ID = matrix.TestType
+				}
+			}
+		}
+
+		if err := startTestMatrices(configs, run.matrices); err != nil {
+			return newStepError(errorCategoryInfrastructure, "Failed to start test, error: %s", err)
+		}
+
+		log.Donef("=> Test started")
+	}
+	return nil
+}
+
+// waitForResults waits for the test matrices and reruns the failed devices.
+func (run *testRun) waitForResults() error {
+	configs := run.configs
+	fmt.Println()
+	log.Infof("Waiting for test results")
+	{
+		if err := waitForTestMatrices(configs, run.matrices); err != nil {
+			return withCategory(err, errorCategoryInfrastructure, "Failed to get test results")
+		}
+		log.Donef("=> Test finished")
+
+		run.results = matrixResults(run.matrices)
+		markOptionalDevices(run.results, run.optionalDevices)
+
+		rerunAttempts := 0
+		if configs.RerunAttempts != "" {
+			var err error
+			rerunAttempts, err = strconv.Atoi(configs.RerunAttempts)
+			if err != nil {
+				return newStepError(errorCategoryConfiguration, "Failed to parse string(%s) to integer, error: %s", configs.RerunAttempts, err)
+			}
+		}
+		for attempt := 1; attempt <= rerunAttempts; attempt++ {
+			reruns := rerunMatrices(run.results, attempt, configs.RerunFailedTestsOnly == "true")
+			if len(reruns) == 0 {
+				break
+			}
+
+			fmt.Println()
+			log.Infof("Rerunning failed devices (%d/%d)", attempt, rerunAttempts)
+			run.reruns = append(run.reruns, reruns...)
+			if err := startTestMatrices(configs, reruns); err != nil {
+				return newStepError(errorCategoryInfrastructure, "Failed to start rerun, error: %s", err)
+			}
+			if err := waitForTestMatrices(configs, reruns); err != nil {
+				return withCategory(err, errorCategoryInfrastructure, "Failed to get rerun results")
+			}
+			log.Donef("=> Rerun finished")
+
+			mergeRerunResults(run.results, matrixResults(reruns))
+		}
+	}
+	run.finished = true
+	return nil
+}
+
+// evaluateResults prints the results and applies the failure policy and the minimum test count.
+func (run *testRun) evaluateResults() error {
+	fmt.Println()
+	log.Infof("Test results:")
+	printResults(os.Stdout, run.results)
+
+	policy := run.policy
+	if unknown := devicesWithUnknownTestCount(run.results); policy.MinTestCount > 0 && len(unknown) > 0 {
+		fmt.Println()
+		log.Warnf("The executed test count is not reported, skipping the minimum test count check of:")
+		for _, result := range unknown {
+			log.Warnf("- %s", deviceName(result))
+		}
+	}
+
+	verdict := policy.apply(run.results)
+	if !verdict.Successful {
+		run.successful = false
+		run.failureCategory = testFailureCategory(verdict.Failed)
+	}
+	if len(verdict.Warned) > 0 {
+		fmt.Println()
+		log.Warnf("Device outcomes allowed by the failure policy:")
+		for _, result := range verdict.Warned {
+			log.Warnf("- %s: %s", deviceName(result), policy.describe(result))
+		}
+	}
+	if len(verdict.Failed) > 0 && verdict.Successful {
+		fmt.Println()
+		log.Warnf("%d of %d device(s) failed, within the allowed %s%%:", len(verdict.Failed), len(run.results), strconv.FormatFloat(policy.MaxFailedPercent, 'f', -1, 64))
+		for _, result := range verdict.Failed {
+			log.Warnf("- %s: %s", deviceName(result), policy.describe(result))
+		}
+	}
+	if !verdict.Successful {
+		fmt.Println()
+		log.Errorf("Failed devices:")
+		for _, result := range verdict.Failed {
+			log.Errorf("- %s: %s", deviceName(result), policy.describe(result))
+		}
+		for _, result := range verdict.Failed {
+			if policy.belowMinTestCount(result) {
+				log.Errorf("Check the test targets and the test runner class of the devices executing fewer tests than expected")
+				break
+			}
+		}
+	}
+
+	for _, matrix := range run.matrices {
+		if matrix.ShardPlan == nil {
+			continue
+		}
+		fmt.Println()
+		if len(run.matrices) > 1 {
+			log.Infof("Shard durations (%s):", matrix.Name)
+		} else {
+			log.Infof("Shard durations:")
+		}
+		printShardDurations(os.Stdout, matrix.ShardPlan, groupStepsByDevice(matrix.Steps))
+	}
+
+	if !run.successful {
+		return newStepError(run.failureCategory, "Test failed (%s)", run.failureCategory)
+	}
+	return nil
+}
+
+// finalize writes the reports of the available results, downloads the test assets and exports the outputs,
+// it runs even if a phase failed, including the failures before starting the test. It returns the error of the failed phase.
+func (run *testRun) finalize(phaseErr error) error {
+	configs := run.configs
+	if phaseErr != nil {
+		run.successful = false
+	}
+	if len(run.results) == 0 && len(run.matrices) > 0 {
+		// the matrices did not finish, the results of the finished steps are reported
+		run.results = matrixResults(run.matrices)
+		markOptionalDevices(run.results, run.optionalDevices)
+		if len(run.results) > 0 {
+			fmt.Println()
+			log.Infof("Unfinished test results:")
+			printResults(os.Stdout, run.results)
+		}
+	}
+
+	if len(run.matrices) > 0 {
+		fmt.Println()
+		log.Infof("Writing JUnit XML report")
+		reportPath, err := writeJUnitReport(run.results)
+		if err != nil {
+			log.Warnf("Failed to write JUnit XML report, error: %s", err)
+		} else if err := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_JUNIT_XML_PATH", reportPath); err != nil {
+			log.Warnf("Failed to export environment (FIREBASE_TEST_JUNIT_XML_PATH), error: %s", err)
+		} else {
+			run.junitReportPath = reportPath
+			log.Donef("=> JUnit XML report written")
+			log.Printf("The JUnit XML report path (%s) is exported to the FIREBASE_TEST_JUNIT_XML_PATH environment variable.", reportPath)
+		}
+	}
+
+	if mode := configs.downloadTestResultsMode(); len(run.matrices) > 0 && (mode == downloadTestResultsAlways || (mode == downloadTestResultsOnFailure && phaseErr != nil)) {
+		fmt.Println()
+		log.Infof("Downloading test assets")
+		if err := run.downloadTestAssets(); err != nil {
+			log.Warnf("Failed to download test assets, error: %s", err)
+		}
+	}
+
+	if run.finished && configs.hasTestType("instrumentation") && configs.InstNumBalancedShards != "" {
+		fmt.Println()
+		log.Infof("Updating test duration history")
+		if resultPaths, err := run.shardHistoryResultPaths(); err != nil {
+			log.Warnf("Failed to get the test results, error: %s", err)
+		} else if err := updateShardHistory(configs.InstShardHistoryDir, resultPaths); err != nil {
+			log.Warnf("Failed to update test duration history, error: %s", err)
+		} else {
+			log.Donef("=> Test duration history saved to (%s)", configs.InstShardHistoryDir)
+		}
+	}
+
+	fmt.Println()
+	log.Infof("Writing results summary")
+	summary := createResultsSummary(run.matrices, run.results, run.assets, run.successful)
+	{
+		summary.JUnitXMLPath = run.junitReportPath
+		summary.AssetsPath = run.assetsPath
+		summary.Assets = run.assets
+		summary.FailedAssets = run.failedAssets
+
+		outputs := map[string]string{"FIREBASE_TEST_OUTCOME": summary.Outcome}
+		for _, outcome := range summaryOutcomes {
+			outputs["FIREBASE_TEST_"+strings.ToUpper(outcome)+"_COUNT"] = strconv.Itoa(summary.Counts[outcome])
+		}
+
+		summaryPath, err := writeResultsSummary(summary)
+		if err != nil {
+			log.Warnf("Failed to write results summary, error: %s", err)
+		} else {
+			outputs["FIREBASE_TEST_RESULTS_JSON"] = summaryPath
+		}
+
+		keys := []string{}
+		for key := range outputs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := tools.ExportEnvironmentWithEnvman(key, outputs[key]); err != nil {
+				log.Warnf("Failed to export environment (%s), error: %s", key, err)
+			}
+		}
+
+		if summaryPath != "" {
+			log.Donef("=> Results summary written")
+			log.Printf("The results summary path (%s) is exported to the FIREBASE_TEST_RESULTS_JSON environment variable.", summaryPath)
+		}
+	}
+
+	fmt.Println()
+	log.Infof("Writing HTML report")
+	if configs.DeployDir == "" {
+		log.Warnf("No deploy directory (BITRISE_DEPLOY_DIR) set, skipping the HTML report")
+	} else {
+		reportPath, err := writeHTMLReport(summary, configs.DeployDir)
+		if err != nil {
+			log.Warnf("Failed to write HTML report, error: %s", err)
+		} else if err := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_HTML_REPORT_PATH", reportPath); err != nil {
+			log.Warnf("Failed to export environment (FIREBASE_TEST_HTML_REPORT_PATH), error: %s", err)
+		} else {
+			log.Donef("=> HTML report written")
+			log.Printf("The HTML report path (%s) is exported to the FIREBASE_TEST_HTML_REPORT_PATH environment variable.", reportPath)
+		}
+	}
+
+	fmt.Println()
+	log.Infof("Writing Markdown summary")
+	{
+		summaryPath, err := writeMarkdownSummary(createMarkdownSummary(summary, configs.BuildURL, maxMarkdownSummarySize))
+		if err != nil {
+			log.Warnf("Failed to write Markdown summary, error: %s", err)
+		} else if err := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_MARKDOWN_SUMMARY_PATH", summaryPath); err != nil {
+			log.Warnf("Failed to export environment (FIREBASE_TEST_MARKDOWN_SUMMARY_PATH), error: %s", err)
+		} else {
+			log.Donef("=> Markdown summary written")
+			log.Printf("The Markdown summary path (%s) is exported to the FIREBASE_TEST_MARKDOWN_SUMMARY_PATH environment variable.", summaryPath)
+		}
+	}
+
+	return phaseErr
+}
+
+// downloadTestAssets downloads the available test assets into a temp dir.
+// The assets failed to download are reported, the others are kept.
+func (run *testRun) downloadTestAssets() error {
+	tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_test_assets")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp dir, error: %s", err)
+	}
+
+	var listErr error
+	for _, matrix := range append(append([]*TestMatrixRun{}, run.matrices...), run.reruns...) {
+		responseModel, err := getTestAssetURLs(run.configs, matrix)
+		if err != nil {
+			log.Warnf("Failed to get the test assets of (%s), error: %s", matrix.Name, err)
+			listErr = err
+			continue
+		}
+
+		// every matrix's assets are downloaded into the directory named by the matrix ID
+		dir := ""
+		if matrix.ID != "" {
+			dir = matrix.ID
+			if err := os.MkdirAll(filepath.Join(tempDir, dir), 0755); err != nil {
+				return fmt.Errorf("Failed to create assets dir, error: %s", err)
+			}
+		}
+
+		for fileName, fileURL := range responseModel {
+			assetName := filepath.ToSlash(filepath.Join(dir, fileName))
+			if err := downloadFile(fileURL, filepath.Join(tempDir, assetName)); err != nil {
+				log.Warnf("Failed to download (%s), error: %s", assetName, err)
+				run.failedAssets = append(run.failedAssets, assetName)
+				continue
+			}
+			run.assets = append(run.assets, assetName)
+		}
+	}
+	if len(run.assets) == 0 && len(run.failedAssets) == 0 && listErr != nil {
+		return listErr
+	}
+	sort.Strings(run.assets)
+	sort.Strings(run.failedAssets)
+	if len(run.assets) == 0 && len(run.failedAssets) > 0 {
+		return fmt.Errorf("none of the %d asset(s) could be downloaded", len(run.failedAssets))
+	}
+	run.assetsPath = tempDir
+
+	if len(run.failedAssets) > 0 {
+		log.Warnf("=> %d of %d asset(s) downloaded", len(run.assets), len(run.assets)+len(run.failedAssets))
+	} else {
+		log.Donef("=> Assets downloaded")
+	}
+	if err := tools.ExportEnvironmentWithEnvman("FIREBASE_TEST_RESULTS_PATH", tempDir); err != nil {
+		log.Warnf("Failed to export environment (FIREBASE_TEST_RESULTS_PATH), error: %s", err)
+	} else {
+		log.Printf("The downloaded test assets path (%s) is exported to the FIREBASE_TEST_RESULTS_PATH environment variable.", tempDir)
+	}
+	return nil
+}
+
+// shardHistoryResultPaths returns the JUnit XML test results of the first run's instrumentation matrices.
+// The downloaded test assets are used, only the test results are downloaded if the test assets were not.
+func (run *testRun) shardHistoryResultPaths() ([]string, error) {
+	var resultPaths []string
+	if run.assetsPath != "" {
+		for _, matrix := range run.matrices {
+			if matrix.TestType != "instrumentation" {
+				continue
+			}
+			for _, assetName := range run.assets {
+				if strings.HasSuffix(assetName, ".xml") && (matrix.ID == "" || strings.HasPrefix(assetName, matrix.ID+"/")) {
+					resultPaths = append(resultPaths, filepath.Join(run.assetsPath, assetName))
+				}
+			}
+		}
+		return resultPaths, nil
+	}
+
+	tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_test_results_xml")
+	if err != nil {
+		return nil, err
+	}
+	for _, matrix := range run.matrices {
+		if matrix.TestType != "instrumentation" {
+			continue
+		}
+		assets, err := getTestAssetURLs(run.configs, matrix)
+		if err != nil {
+			return nil, err
+		}
+		for fileName, fileURL := range assets {
+			if !strings.HasSuffix(fileName, ".xml") {
+				continue
+			}
+			resultPath := filepath.Join(tempDir, strings.Replace(filepath.Join(matrix.ID, fileName), string(filepath.Separator), "_", -1))
+			if err := downloadFile(fileURL, resultPath); err != nil {
+				return nil, err
+			}
+			resultPaths = append(resultPaths, resultPath)
+		}
+	}
+	return resultPaths, nil
+}
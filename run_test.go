@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTestLabBackend serves the assets, upload, matrix and test cases endpoints of the step's backend.
+type fakeTestLabBackend struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu            sync.Mutex
+	assetsRequest *AssetsUploadRequest
+	uploads       map[string]int
+	models        map[string]*TestMatrix
+	polls         map[string]int
+	// steps are the steps reported from the second poll of each matrix, the first poll reports validation
+	steps []*Step
+	// testCases are the test cases by step ID, served one per page
+	testCases map[string][]*TestCase
+	// assets are the test asset contents by matrix ID and file name
+	assets map[string]map[string]string
+}
+
+func newFakeTestLabBackend(t *testing.T, steps []*Step, testCases map[string][]*TestCase) *fakeTestLabBackend {
+	backend := &fakeTestLabBackend{
+		t:         t,
+		uploads:   map[string]int{},
+		models:    map[string]*TestMatrix{},
+		polls:     map[string]int{},
+		steps:     steps,
+		testCases: testCases,
+	}
+	backend.server = httptest.NewServer(http.HandlerFunc(backend.serveHTTP))
+	return backend
+}
+
+func (backend *fakeTestLabBackend) configs() ConfigsModel {
+	return ConfigsModel{APIBaseURL: backend.server.URL, AppSlug: "app", BuildSlug: "build", APIToken: "token"}
+}
+
+func (backend *fakeTestLabBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		backend.t.Errorf("Failed to read request body, error: %s", err)
+	}
+	matrixID := r.URL.Query().Get("matrix_id")
+
+	var response interface{}
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/assets/app/build/token":
+		backend.assetsRequest = &AssetsUploadRequest{}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, backend.assetsRequest); err != nil {
+				backend.t.Errorf("Failed to unmarshal assets request, error: %s", err)
+			}
+		}
+		uploadURLs := UploadURLRequest{AppURL: backend.server.URL + "/upload/app", AppGcsPath: "gs://bucket/app", TestAppURL: backend.server.URL + "/upload/test"}
+		for _, name := range backend.assetsRequest.AdditionalFiles {
+			uploadURLs.AdditionalFiles = append(uploadURLs.AdditionalFiles, &AdditionalFile{Name: name, UploadURL: backend.server.URL + "/upload/" + name, GcsPath: "gs://bucket/" + name})
+		}
+		response = uploadURLs
+	case r.Method == "GET" && r.URL.Path == "/assets/app/build/token":
+		assetURLs := map[string]string{}
+		for name := range backend.assets[matrixID] {
+			assetURLs[name] = backend.server.URL + "/download/" + name + "?matrix_id=" + matrixID
+		}
+		response = assetURLs
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/download/"):
+		content, ok := backend.assets[matrixID][strings.TrimPrefix(r.URL.Path, "/download/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			backend.t.Errorf("Failed to write response, error: %s", err)
+		}
+		return
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/upload/"):
+		backend.uploads[strings.TrimPrefix(r.URL.Path, "/upload/")] = len(body)
+		response = struct{}{}
+	case r.Method == "POST" && r.URL.Path == "/app/build/token":
+		model := &TestMatrix{}
+		if err := json.Unmarshal(body, model); err != nil {
+			backend.t.Errorf("Failed to unmarshal test matrix, error: %s", err)
+		}
+		backend.models[matrixID] = model
+		response = struct{}{}
+	case r.Method == "GET" && r.URL.Path == "/app/build/token":
+		backend.polls[matrixID]++
+		steps := []*Step{}
+		if backend.polls[matrixID] > 1 {
+			steps = backend.steps
+		}
+		response = ListStepsResponse{Steps: steps}
+	case r.Method == "GET" && r.URL.Path == "/testcases/app/build/token":
+		page := 0
+		if pageToken := r.URL.Query().Get("page_token"); pageToken != "" {
+			var err error
+			// t.Fatal must be called from the test goroutine, so fail the request instead
+			if page, err = strconv.Atoi(pageToken); err != nil {
+				backend.t.Errorf("Invalid page token: %s, error: %s", pageToken, err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		testCases := backend.testCases[r.URL.Query().Get("step_id")]
+		testCasesPage := ListTestCasesResponse{}
+		if page < len(testCases) {
+			testCasesPage.TestCases = testCases[page : page+1]
+		}
+		if page+1 < len(testCases) {
+			testCasesPage.NextPageToken = strconv.Itoa(page + 1)
+		}
+		response = testCasesPage
+	default:
+		backend.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		backend.t.Errorf("Failed to write response, error: %s", err)
+	}
+}
+
+// createTestXcTestZip writes a build-for-testing zip with an .xctest bundle and an .xctestrun file.
+func createTestXcTestZip(t *testing.T, zipPath string) {
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(file)
+	for _, name := range []string{"Debug-iphoneos/AppUITests-Runner.app/PlugIns/AppUITests.xctest/Info.plist", "App_iphoneos12.0-arm64.xctestrun"} {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// xcTestConfigs returns the valid configs of an xctest run.
+func xcTestConfigs(configs ConfigsModel, xcTestZipPath, xcTestRunPath string) ConfigsModel {
+	configs.TestType = "ios_xctest"
+	configs.XcTestZipPath = xcTestZipPath
+	configs.XcTestRunPath = xcTestRunPath
+	configs.XcodeVersion = "10.1"
+	configs.TestDevices = "iphone8,12.0,en,portrait\niphonex,12.0,en,portrait"
+	configs.TestTimeout = "900"
+	configs.AutoGoogleLogin = "false"
+	configs.RecordVideo = "true"
+	configs.PerformanceMetrics = "true"
+	configs.FlakyTestPolicy = flakyPolicySuccess
+	configs.DownloadTestResults = "false"
+	configs.RerunFailedTestsOnly = "false"
+	return configs
+}
+
+func TestXcTestRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "xctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Log(err)
+		}
+	}()
+	xcTestZipPath := filepath.Join(tmpDir, "tests.zip")
+	createTestXcTestZip(t, xcTestZipPath)
+	xcTestRunPath := filepath.Join(tmpDir, "App.xctestrun")
+	if err := ioutil.WriteFile(xcTestRunPath, []byte("<plist/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dimensions := func(model string) []*StepDimensionValueEntry {
+		return []*StepDimensionValueEntry{{Key: "Model", Value: model}, {Key: "Version", Value: "12.0"}, {Key: "Locale", Value: "en"}, {Key: "Orientation", Value: "portrait"}}
+	}
+	steps := []*Step{
+		{StepID: "step-0", State: "complete", Outcome: &Outcome{Summary: "success"}, DimensionValue: dimensions("iphone8"), TestExecution: &TestExecutionStep{TestSuiteOverviews: []*TestSuiteOverview{{TotalCount: 2}}}},
+		{StepID: "step-1", State: "complete", Outcome: &Outcome{Summary: "failure"}, DimensionValue: dimensions("iphonex"), TestExecution: &TestExecutionStep{TestSuiteOverviews: []*TestSuiteOverview{{TotalCount: 2, FailureCount: 1}}}},
+	}
+	testCases := map[string][]*TestCase{
+		"step-1": {
+			{Status: "passed", TestCaseReference: &TestCaseReference{ClassName: "AppUITests", Name: "testLaunch"}},
+			{Status: "failed", TestCaseReference: &TestCaseReference{ClassName: "AppUITests", Name: "testLogin"}, StackTraces: []*StackTrace{{Exception: "XCTAssertEqual failed"}}},
+		},
+	}
+	backend := newFakeTestLabBackend(t, steps, testCases)
+	defer backend.server.Close()
+
+	run := newTestRun(xcTestConfigs(backend.configs(), xcTestZipPath, xcTestRunPath))
+	for _, phase := range []func() error{run.prepare, run.upload, run.startTest, run.waitForResults} {
+		if err := phase(); err != nil {
+			t.Fatalf("phase failed, error: %s", err)
+		}
+	}
+
+	if backend.assetsRequest.AppType != appTypeXcTest {
+		t.Errorf("app type = %q, want %q", backend.assetsRequest.AppType, appTypeXcTest)
+	}
+	if _, ok := backend.uploads["app"]; !ok {
+		t.Errorf("xctest zip not uploaded, uploads: %v", backend.uploads)
+	}
+	if _, ok := backend.uploads["App.xctestrun"]; !ok {
+		t.Errorf("xctestrun not uploaded, uploads: %v", backend.uploads)
+	}
+
+	model, ok := backend.models[""]
+	if !ok || len(backend.models) != 1 {
+		t.Fatalf("started matrices = %v, want the default matrix", backend.models)
+	}
+	xcTest := model.TestSpecification.IosXcTest
+	if xcTest == nil || xcTest.TestsZip.GcsPath != "gs://bucket/app" || xcTest.Xctestrun.GcsPath != "gs://bucket/App.xctestrun" || xcTest.XcodeVersion != "10.1" {
+		t.Errorf("ios xctest = %+v, want the uploaded zip and xctestrun", xcTest)
+	}
+	if model.TestSpecification.AndroidInstrumentationTest != nil || model.TestSpecification.TestSetup != nil {
+		t.Errorf("test specification = %+v, want iOS only", model.TestSpecification)
+	}
+	if devices := model.EnvironmentMatrix.IosDeviceList.IosDevices; len(devices) != 2 || devices[1].IosModelID != "iphonex" {
+		t.Errorf("ios devices = %v, want iphone8 and iphonex", devices)
+	}
+	if backend.polls[""] != 2 {
+		t.Errorf("polls = %d, want 2", backend.polls[""])
+	}
+
+	if !run.finished || len(run.results) != 2 {
+		t.Fatalf("results = %v, finished = %v, want 2 finished results", run.results, run.finished)
+	}
+	failed := run.results[1].failedTestCases()
+	if len(failed) != 1 || failed[0].TestCaseReference.Name != "testLogin" {
+		t.Errorf("failed test cases = %v, want testLogin", failed)
+	}
+	if len(run.results[0].testCases()) != 0 {
+		t.Errorf("test cases of the passed device = %v, want none", run.results[0].testCases())
+	}
+}
+
+func TestValidateXcTestUnsupportedInputs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "xctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Log(err)
+		}
+	}()
+	xcTestZipPath := filepath.Join(tmpDir, "tests.zip")
+	createTestXcTestZip(t, xcTestZipPath)
+	xcTestRunPath := filepath.Join(tmpDir, "App.xctestrun")
+	if err := ioutil.WriteFile(xcTestRunPath, []byte("<plist/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := newFakeTestLabBackend(t, nil, nil)
+	defer backend.server.Close()
+
+	tests := []struct {
+		name    string
+		set     func(configs *ConfigsModel)
+		wantErr string
+	}{
+		{name: "supported inputs", set: func(configs *ConfigsModel) {}},
+		{name: "additional APKs", set: func(configs *ConfigsModel) { configs.AdditionalApks = "companion.apk" }, wantErr: "Issue with AdditionalApks"},
+		{name: "files to push", set: func(configs *ConfigsModel) { configs.FilesToPush = "seed.db,/sdcard/seed.db" }, wantErr: "Issue with FilesToPush"},
+		{name: "directories to pull", set: func(configs *ConfigsModel) { configs.DirectoriesToPull = "/sdcard/screenshots" }, wantErr: "Issue with DirectoriesToPull"},
+		{name: "environment variables", set: func(configs *ConfigsModel) { configs.EnvironmentVariables = "key=value" }, wantErr: "Issue with EnvironmentVariables"},
+		{name: "auto google login", set: func(configs *ConfigsModel) { configs.AutoGoogleLogin = "true" }, wantErr: "Issue with AutoGoogleLogin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := xcTestConfigs(backend.configs(), xcTestZipPath, xcTestRunPath)
+			tt.set(&configs)
+			err := configs.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("validate() error = %s, want none", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("validate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadTestAssets(t *testing.T) {
+	backend := newFakeTestLabBackend(t, nil, nil)
+	defer backend.server.Close()
+	backend.assets = map[string]map[string]string{
+		"instrumentation":         {"test_result_1.xml": "instrumentation", "Nexus5-23-en-portrait_logcat": "instrumentation logcat"},
+		"robo":                    {"test_result_1.xml": "robo"},
+		"instrumentation-rerun-1": {"test_result_1.xml": "rerun"},
+	}
+
+	run := newTestRun(backend.configs())
+	instrumentation := &TestMatrixRun{ID: "instrumentation", TestType: "instrumentation"}
+	run.matrices = []*TestMatrixRun{instrumentation, {ID: "robo", TestType: "robo"}}
+	run.reruns = []*TestMatrixRun{{ID: instrumentation.rerunID(1), TestType: "instrumentation", Attempt: 1, Origin: instrumentation}}
+	if err := run.downloadTestAssets(); err != nil {
+		t.Fatalf("downloadTestAssets() error = %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(run.assetsPath); err != nil {
+			t.Log(err)
+		}
+	}()
+
+	wantAssets := map[string]string{
+		"instrumentation-rerun-1/test_result_1.xml":    "rerun",
+		"instrumentation/Nexus5-23-en-portrait_logcat": "instrumentation logcat",
+		"instrumentation/test_result_1.xml":            "instrumentation",
+		"robo/test_result_1.xml":                       "robo",
+	}
+	if len(run.assets) != len(wantAssets) || len(run.failedAssets) != 0 {
+		t.Errorf("assets = %v, failed assets = %v, want %d assets", run.assets, run.failedAssets, len(wantAssets))
+	}
+	for _, asset := range run.assets {
+		content, err := ioutil.ReadFile(filepath.Join(run.assetsPath, asset))
+		if err != nil {
+			t.Errorf("Failed to read asset (%s), error: %s", asset, err)
+			continue
+		}
+		if string(content) != wantAssets[asset] {
+			t.Errorf("asset (%s) = %q, want %q", asset, content, wantAssets[asset])
+		}
+	}
+
+	resultPaths, err := run.shardHistoryResultPaths()
+	if err != nil {
+		t.Fatalf("shardHistoryResultPaths() error = %s", err)
+	}
+	if want := []string{filepath.Join(run.assetsPath, "instrumentation/test_result_1.xml")}; len(resultPaths) != 1 || resultPaths[0] != want[0] {
+		t.Errorf("shardHistoryResultPaths() = %v, want %v", resultPaths, want)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	shardHistoryFileName = "test_class_durations.json"
+	shardHistoryVersion  = 1
+)
+
+// ShardHistory holds the test class durations (in seconds) measured in previous runs.
+type ShardHistory struct {
+	Version            int                `json:"version"`
+	TestClassDurations map[string]float64 `json:"test_class_durations"`
+}
+
+// ShardPlan is the result of the timing based shard planning.
+type ShardPlan struct {
+	Shards            [][]string
+	PredictedDuration []float64
+}
+
+func shardHistoryPath(historyDir string) string {
+	return filepath.Join(historyDir, shardHistoryFileName)
+}
+
+// readShardHistory returns nil if no history exists yet.
+func readShardHistory(historyDir string) (*ShardHistory, error) {
+	content, err := ioutil.ReadFile(shardHistoryPath(historyDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	history := &ShardHistory{}
+	if err := json.Unmarshal(content, history); err != nil {
+		return nil, fmt.Errorf("failed to parse shard history, error: %s", err)
+	}
+	if history.Version != shardHistoryVersion || len(history.TestClassDurations) == 0 {
+		return nil, nil
+	}
+	return history, nil
+}
+
+func writeShardHistory(historyDir string, history *ShardHistory) error {
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(shardHistoryPath(historyDir), content, 0644)
+}
+
+// planBalancedShards distributes the test classes of the test apk into numShards shards,
+// based on the test class durations of the previous runs.
+// Returns nil if there is no history to plan with.
+func planBalancedShards(testApkPath, historyDir, testClassPattern string, numShards int) (*ShardPlan, error) {
+	history, err := readShardHistory(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		return nil, nil
+	}
+
+	pattern, err := regexp.Compile(testClassPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid test class pattern (%s), error: %s", testClassPattern, err)
+	}
+
+	classes, err := listConcreteClasses(testApkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	testClasses := []string{}
+	for _, class := range classes {
+		if pattern.MatchString(class) {
+			testClasses = append(testClasses, class)
+		}
+	}
+	if len(testClasses) == 0 {
+		return nil, fmt.Errorf("no test class matching (%s) found in test apk (%s)", testClassPattern, testApkPath)
+	}
+
+	return binPackTestClasses(testClasses, history.TestClassDurations, numShards), nil
+}
+
+// binPackTestClasses assigns the test classes, the longest first, to the shard with the shortest predicted duration.
+// Classes without history are predicted with the average known duration.
+func binPackTestClasses(testClasses []string, durations map[string]float64, numShards int) *ShardPlan {
+	sum := 0.0
+	known := 0
+	for _, class := range testClasses {
+		if duration, ok := durations[class]; ok {
+			sum += duration
+			known++
+		}
+	}
+	average := 0.0
+	if known > 0 {
+		average = sum / float64(known)
+	}
+
+	predicted := map[string]float64{}
+	for _, class := range testClasses {
+		if duration, ok := durations[class]; ok {
+			predicted[class] = duration
+		} else {
+			predicted[class] = average
+		}
+	}
+
+	sorted := append([]string{}, testClasses...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if predicted[sorted[i]] != predicted[sorted[j]] {
+			return predicted[sorted[i]] > predicted[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	if numShards > len(sorted) {
+		numShards = len(sorted)
+	}
+
+	plan := &ShardPlan{
+		Shards:            make([][]string, numShards),
+		PredictedDuration: make([]float64, numShards),
+	}
+	for _, class := range sorted {
+		shortest := 0
+		for i := range plan.Shards {
+			// the shards of the same predicted duration, e.g. without history, are filled evenly
+			if plan.PredictedDuration[i] < plan.PredictedDuration[shortest] ||
+				(plan.PredictedDuration[i] == plan.PredictedDuration[shortest] && len(plan.Shards[i]) < len(plan.Shards[shortest])) {
+				shortest = i
+			}
+		}
+		plan.Shards[shortest] = append(plan.Shards[shortest], class)
+		plan.PredictedDuration[shortest] += predicted[class]
+	}
+	return plan
+}
+
+// testTargets returns the shards in the format of the manual sharding's test targets.
+func (plan ShardPlan) testTargets() [][]string {
+	shards := [][]string{}
+	for _, classes := range plan.Shards {
+		targets := []string{}
+		for _, class := range classes {
+			targets = append(targets, "class "+class)
+		}
+		shards = append(shards, targets)
+	}
+	return shards
+}
+
+// printShardDurations writes the predicted and the actual (slowest device's) duration of each shard.
+func printShardDurations(out io.Writer, plan *ShardPlan, results []*DeviceResult) {
+	actual := make([]time.Duration, len(plan.Shards))
+	for _, result := range results {
+		for _, step := range result.Steps {
+			index := shardIndex(step)
+			if index < 0 || index >= len(actual) {
+				continue
+			}
+			if duration := step.RunDuration.duration(); duration > actual[index] {
+				actual[index] = duration
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Shard\tTest classes\tPredicted\tActual\t")
+	for i := range plan.Shards {
+		fmt.Fprintln(w, fmt.Sprintf("%d\t%d\t%.0fs\t%.0fs\t", i, len(plan.Shards[i]), plan.PredictedDuration[i], actual[i].Seconds()))
+	}
+	w.Flush()
+}
+
+// parseTestClassDurations sums the test case durations per test class of a JUnit XML test result.
+func parseTestClassDurations(content []byte) (map[string]float64, error) {
+	report := junitReport{}
+	if err := xml.Unmarshal(content, &report); err != nil {
+		// the result of a single test suite has no testsuites root element
+		suite := junitReportSuite{}
+		if suiteErr := xml.Unmarshal(content, &suite); suiteErr != nil {
+			return nil, err
+		}
+		report.TestSuites = []junitReportSuite{suite}
+	}
+
+	testCases := []junitReportCase{}
+	for _, suite := range report.TestSuites {
+		testCases = append(testCases, suite.TestCases...)
+	}
+
+	durations := map[string]float64{}
+	for _, testCase := range testCases {
+		if testCase.ClassName == "" {
+			continue
+		}
+		duration, err := strconv.ParseFloat(testCase.Time, 64)
+		if err != nil {
+			continue
+		}
+		durations[testCase.ClassName] += duration
+	}
+	return durations, nil
+}
+
+// updateShardHistory stores the measured test class durations of the JUnit XML test results.
+// Every device's test result is a separate file, the durations are averaged over the devices.
+func updateShardHistory(historyDir string, resultPaths []string) error {
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	for _, resultPath := range resultPaths {
+		content, err := ioutil.ReadFile(resultPath)
+		if err != nil {
+			return err
+		}
+
+		durations, err := parseTestClassDurations(content)
+		if err != nil {
+			log.Warnf("Failed to parse test result (%s), error: %s", resultPath, err)
+			continue
+		}
+		for class, duration := range durations {
+			sums[class] += duration
+			counts[class]++
+		}
+	}
+
+	if len(sums) == 0 {
+		return fmt.Errorf("no test class duration found in the test results")
+	}
+
+	history, err := readShardHistory(historyDir)
+	if err != nil {
+		log.Warnf("Failed to read shard history, starting a new one, error: %s", err)
+		history = nil
+	}
+	if history == nil {
+		history = &ShardHistory{Version: shardHistoryVersion, TestClassDurations: map[string]float64{}}
+	}
+	for class, sum := range sums {
+		history.TestClassDurations[class] = sum / float64(counts[class])
+	}
+
+	return writeShardHistory(historyDir, history)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBinPackTestClasses(t *testing.T) {
+	tests := []struct {
+		name          string
+		testClasses   []string
+		durations     map[string]float64
+		numShards     int
+		wantShards    [][]string
+		wantDurations []float64
+	}{
+		{
+			name:          "longest first into the shortest shard",
+			testClasses:   []string{"A", "B", "C", "D"},
+			durations:     map[string]float64{"A": 10, "B": 6, "C": 5, "D": 1},
+			numShards:     2,
+			wantShards:    [][]string{{"A", "D"}, {"B", "C"}},
+			wantDurations: []float64{11, 11},
+		},
+		{
+			name:          "classes without history are predicted with the average",
+			testClasses:   []string{"A", "B", "New"},
+			durations:     map[string]float64{"A": 8, "B": 4},
+			numShards:     2,
+			wantShards:    [][]string{{"A"}, {"New", "B"}},
+			wantDurations: []float64{8, 10},
+		},
+		{
+			name:          "no history, sorted by name",
+			testClasses:   []string{"C", "A", "B"},
+			durations:     map[string]float64{},
+			numShards:     3,
+			wantShards:    [][]string{{"A"}, {"B"}, {"C"}},
+			wantDurations: []float64{0, 0, 0},
+		},
+		{
+			name:          "more shards than classes",
+			testClasses:   []string{"A", "B"},
+			durations:     map[string]float64{"A": 1, "B": 2},
+			numShards:     5,
+			wantShards:    [][]string{{"B"}, {"A"}},
+			wantDurations: []float64{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := binPackTestClasses(tt.testClasses, tt.durations, tt.numShards)
+			if !reflect.DeepEqual(plan.Shards, tt.wantShards) {
+				t.Errorf("binPackTestClasses() shards = %v, want %v", plan.Shards, tt.wantShards)
+			}
+			if !reflect.DeepEqual(plan.PredictedDuration, tt.wantDurations) {
+				t.Errorf("binPackTestClasses() durations = %v, want %v", plan.PredictedDuration, tt.wantDurations)
+			}
+		})
+	}
+}
+
+func TestParseTestClassDurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "single test suite",
+			content: `<testsuite name="" tests="3">
+  <testcase name="a" classname="com.LoginTest" time="1.5" />
+  <testcase name="b" classname="com.LoginTest" time="0.5" />
+  <testcase name="c" classname="com.SignupTest" time="2" />
+</testsuite>`,
+			want: map[string]float64{"com.LoginTest": 2, "com.SignupTest": 2},
+		},
+		{
+			name: "test suites",
+			content: `<testsuites>
+  <testsuite name="a"><testcase name="a" classname="com.LoginTest" time="1" /></testsuite>
+  <testsuite name="b"><testcase name="b" classname="com.LoginTest" time="3" /></testsuite>
+</testsuites>`,
+			want: map[string]float64{"com.LoginTest": 4},
+		},
+		{
+			name:    "test cases without class or time are skipped",
+			content: `<testsuite><testcase name="a" time="1" /><testcase name="b" classname="com.LoginTest" /></testsuite>`,
+			want:    map[string]float64{},
+		},
+		{
+			name:    "invalid xml",
+			content: `<testsuite>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTestClassDurations([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTestClassDurations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTestClassDurations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -15,4 +15,7 @@ rsync -avh --quiet "${THIS_SCRIPT_DIR}/" "${full_package_path}/"
 
 export GOPATH="${tmp_gopath_dir}"
 export GO15VENDOREXPERIMENT=1
-go run "${full_package_path}/main.go"
\ No newline at end of file
+export GO111MODULE=off
+# go run exits with 1 on every failure, the binary keeps the step's exit codes
+go build -o "${tmp_gopath_dir}/bin/steps-firebase-testlab" "${go_package_name}"
+exec "${tmp_gopath_dir}/bin/steps-firebase-testlab"
\ No newline at end of file
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	summaryFileName = "firebase_test_results.json"
+	// summaryVersion has to be increased on breaking changes of the summary's format.
+	summaryVersion = 1
+)
+
+// summaryOutcomes are the outcome summaries counted in the results summary.
+var summaryOutcomes = []string{"success", "flaky", "skipped", "inconclusive", "failure"}
+
+// ResultsSummary is the machine-readable summary of the test results.
+type ResultsSummary struct {
+	Version int `json:"version"`
+	// Outcome is the most severe device outcome.
+	Outcome string `json:"outcome"`
+	// Successful is the step's verdict, it takes the failure policy and the minimum test count into account.
+	Successful   bool             `json:"successful"`
+	Counts       map[string]int   `json:"counts"`
+	Matrices     []*MatrixSummary `json:"matrices"`
+	Devices      []*DeviceSummary `json:"devices"`
+	JUnitXMLPath string           `json:"junit_xml_path,omitempty"`
+	AssetsPath   string           `json:"assets_path,omitempty"`
+	Assets       []string         `json:"assets,omitempty"`
+	FailedAssets []string         `json:"failed_assets,omitempty"`
+}
+
+// MatrixSummary ...
+type MatrixSummary struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	TestType string `json:"test_type"`
+	State    string `json:"state"`
+	Devices  int    `json:"devices"`
+	Attempts int    `json:"attempts"`
+}
+
+// DeviceSummary ...
+type DeviceSummary struct {
+	TestType        string             `json:"test_type"`
+	Matrix          string             `json:"matrix"`
+	Dimensions      map[string]string  `json:"dimensions"`
+	Optional        bool               `json:"optional"`
+	State           string             `json:"state"`
+	Outcome         string             `json:"outcome"`
+	Details         []string           `json:"details"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	TestCount       *int               `json:"test_count,omitempty"`
+	Attempts        []string           `json:"attempts"`
+	Steps           []*StepSummary     `json:"steps"`
+	TestCases       []*TestCaseSummary `json:"test_cases,omitempty"`
+	// Assets are the downloaded test assets of the device, relative to the assets path.
+	Assets []string `json:"assets,omitempty"`
+}
+
+// TestCaseSummary ...
+type TestCaseSummary struct {
+	Name            string  `json:"name"`
+	ClassName       string  `json:"class_name"`
+	Status          string  `json:"status"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	StackTrace      string  `json:"stack_trace,omitempty"`
+}
+
+// StepSummary ...
+type StepSummary struct {
+	Shard           *int     `json:"shard,omitempty"`
+	Scenario        string   `json:"scenario,omitempty"`
+	Attempt         int64    `json:"attempt"`
+	State           string   `json:"state"`
+	Outcome         string   `json:"outcome"`
+	Details         []string `json:"details"`
+	DurationSeconds float64  `json:"duration_seconds"`
+}
+
+// createResultsSummary summarizes the matrices and the device results, reruns are listed as their first run's attempts.
+func createResultsSummary(matrices []*TestMatrixRun, results []*DeviceResult, assets []string, successful bool) *ResultsSummary {
+	summary := &ResultsSummary{
+		Version:    summaryVersion,
+		Successful: successful,
+		Counts:     map[string]int{},
+		Matrices:   []*MatrixSummary{},
+		Devices:    []*DeviceSummary{},
+	}
+	for _, outcome := range summaryOutcomes {
+		summary.Counts[outcome] = countOutcome(results, outcome)
+	}
+
+	outcomes := []*Outcome{}
+	for _, result := range results {
+		outcomes = append(outcomes, result.Outcome)
+	}
+	summary.Outcome = mergeOutcomes(outcomes).Summary
+
+	for _, matrix := range matrices {
+		matrixSummary := &MatrixSummary{ID: matrix.ID, Name: matrix.Name, TestType: matrix.TestType, State: "finished"}
+		if !matrix.finished() {
+			matrixSummary.State = "unfinished"
+		}
+		for _, result := range results {
+			if result.matrixRun != matrix {
+				continue
+			}
+			matrixSummary.Devices++
+			if len(result.History) > matrixSummary.Attempts {
+				matrixSummary.Attempts = len(result.History)
+			}
+		}
+		summary.Matrices = append(summary.Matrices, matrixSummary)
+	}
+
+	for _, result := range results {
+		deviceSummary := &DeviceSummary{
+			Dimensions: result.Dimensions,
+			Optional:   result.Optional,
+			State:      "complete",
+			Outcome:    result.Outcome.Summary,
+			Details:    outcomeDetails(result.Outcome),
+			Attempts:   []string{},
+			Steps:      []*StepSummary{},
+		}
+		if result.matrixRun != nil {
+			deviceSummary.TestType = result.matrixRun.TestType
+			deviceSummary.Matrix = result.matrixRun.Name
+		}
+		if result.reportsTestCount() {
+			testCount := result.testCount()
+			deviceSummary.TestCount = &testCount
+		}
+		for _, outcome := range result.History {
+			deviceSummary.Attempts = append(deviceSummary.Attempts, outcome.Summary)
+		}
+
+		for _, step := range result.Steps {
+			stepSummary := &StepSummary{
+				Scenario:        stepDimensions(step)["Scenario"],
+				Attempt:         attemptNumber(step),
+				State:           step.State,
+				Details:         outcomeDetails(step.Outcome),
+				DurationSeconds: step.RunDuration.duration().Seconds(),
+			}
+			if index := shardIndex(step); index >= 0 {
+				stepSummary.Shard = &index
+			}
+			if step.Outcome != nil {
+				stepSummary.Outcome = step.Outcome.Summary
+			}
+			if step.State != "complete" {
+				deviceSummary.State = step.State
+			}
+			deviceSummary.DurationSeconds += stepSummary.DurationSeconds
+			deviceSummary.Steps = append(deviceSummary.Steps, stepSummary)
+		}
+		for _, testCase := range result.testCases() {
+			deviceSummary.TestCases = append(deviceSummary.TestCases, &TestCaseSummary{
+				Name:            testCase.TestCaseReference.Name,
+				ClassName:       testCase.TestCaseReference.ClassName,
+				Status:          testCase.Status,
+				DurationSeconds: testCase.ElapsedTime.duration().Seconds(),
+				StackTrace:      testCase.stackTrace(),
+			})
+		}
+		deviceSummary.Assets = deviceAssets(result, assets)
+		summary.Devices = append(summary.Devices, deviceSummary)
+	}
+	return summary
+}
+
+// deviceAssets returns the assets of the device's matrices, the first run's and the reruns', which are named by the device key.
+// Every matrix's assets are in the directory named by the matrix ID, the assets of a single matrix without ID are in the root.
+func deviceAssets(result *DeviceResult, assets []string) []string {
+	if result.matrixRun == nil {
+		return nil
+	}
+
+	dirs := map[string]bool{result.matrixRun.ID: true}
+	for attempt := 1; attempt < len(result.History); attempt++ {
+		dirs[result.matrixRun.rerunID(attempt)] = true
+	}
+
+	key := deviceKey(result.Dimensions)
+	var matching []string
+	for _, asset := range assets {
+		dir, name := path.Split(asset)
+		if dirs[strings.TrimSuffix(dir, "/")] && strings.Contains(name, key) {
+			matching = append(matching, asset)
+		}
+	}
+	return matching
+}
+
+// writeResultsSummary writes the results summary into a temp dir and returns its path.
+func writeResultsSummary(summary *ResultsSummary) (string, error) {
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tempDir, err := pathutil.NormalizedOSTempDirPath("firebase_test_summary")
+	if err != nil {
+		return "", err
+	}
+
+	summaryPath := filepath.Join(tempDir, summaryFileName)
+	if err := ioutil.WriteFile(summaryPath, content, 0644); err != nil {
+		return "", err
+	}
+	return summaryPath, nil
+}
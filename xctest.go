@@ -0,0 +1,46 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const appTypeXcTest = "xctest"
+
+// validateXcTestZip checks if the given file is a zip of the build-for-testing products:
+// it has to contain an .xctest bundle, and exactly one .xctestrun file at its root
+// unless the xctestrun file is uploaded separately.
+func validateXcTestZip(zipPath string, hasXcTestRun bool) error {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("xctest zip (%s) is not a valid zip archive, error: %s", zipPath, err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Warnf("Failed to close xctest zip (%s), error: %s", zipPath, err)
+		}
+	}()
+
+	hasXcTestBundle := false
+	xcTestRuns := []string{}
+	for _, file := range reader.File {
+		if strings.Contains(file.Name, ".xctest/") {
+			hasXcTestBundle = true
+		}
+		if !strings.Contains(strings.TrimSuffix(file.Name, "/"), "/") && path.Ext(file.Name) == ".xctestrun" {
+			xcTestRuns = append(xcTestRuns, file.Name)
+		}
+	}
+
+	if !hasXcTestBundle {
+		return fmt.Errorf("xctest zip (%s) does not contain an .xctest bundle", zipPath)
+	}
+	if !hasXcTestRun && len(xcTestRuns) != 1 {
+		return fmt.Errorf("xctest zip (%s) has to contain exactly one .xctestrun file at its root if no xctestrun file is specified, found: %d", zipPath, len(xcTestRuns))
+	}
+	return nil
+}